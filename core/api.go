@@ -0,0 +1,326 @@
+package core
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// apiPrefix is the path prefix of the HTTP API.
+const apiPrefix = "/api/v1/"
+
+// newAPIHandler returns the handler of the HTTP API below apiPrefix. All
+// endpoints need the API token, if one is set, except the OpenAPI
+// description and the callbacks of the installers, which cannot keep a
+// secret. Without a token the API is read-only.
+func (s *Service) newAPIHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/"), "/")
+		if !isPublicAPI(r.Method, parts) && !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pxesrv"`)
+			writeError(w, http.StatusUnauthorized, "missing or invalid API token")
+			return
+		}
+		if !isPublicAPI(r.Method, parts) && r.Method != http.MethodGet && r.Method != http.MethodHead && s.settings().APIToken == "" {
+			writeError(w, http.StatusForbidden, "api.token is not set, the API is read-only")
+			return
+		}
+		switch parts[0] {
+		case "openapi.json":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(openAPISpec))
+		case "leases":
+			s.serveLeaseAPI(w, r, parts[1:])
+		case "hosts":
+			s.serveHostAPI(w, r, parts[1:])
+		case "reservations":
+			s.serveReservationAPI(w, r, parts[1:])
+		case "transfers":
+			s.serveTransferAPI(w, r, parts[1:])
+		case "templates":
+			s.serveTemplateAPI(w, r, parts[1:])
+		case "config":
+			if !allowMethods(w, r, parts[1:], http.MethodGet) {
+				return
+			}
+			writeJSON(w, http.StatusOK, s.runtimeConfig())
+		default:
+			writeError(w, http.StatusNotFound, "not found")
+		}
+	})
+}
+
+// isPublicAPI reports whether an endpoint is open without the API token.
+func isPublicAPI(method string, parts []string) bool {
+	if len(parts) == 1 && parts[0] == "openapi.json" {
+		return true
+	}
+	if len(parts) == 3 && parts[0] == "hosts" && method == http.MethodPost {
+		return parts[2] == "events" || parts[2] == "installed"
+	}
+	return false
+}
+
+// authorized checks the bearer token of an API request.
+func (s *Service) authorized(r *http.Request) bool {
+	cfg := s.settings()
+	if cfg.APIToken == "" {
+		return true
+	}
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(cfg.APIToken)) == 1
+}
+
+// allowMethods answers requests with trailing path elements or a method
+// not in methods, and reports whether the request should be served.
+func allowMethods(w http.ResponseWriter, r *http.Request, rest []string, methods ...string) bool {
+	if len(rest) > 0 {
+		writeError(w, http.StatusNotFound, "not found")
+		return false
+	}
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+	return false
+}
+
+// serveLeaseAPI handles /api/v1/leases and /api/v1/leases/{mac}.
+func (s *Service) serveLeaseAPI(w http.ResponseWriter, r *http.Request, parts []string) {
+	if s.dhcpService == nil {
+		writeError(w, http.StatusServiceUnavailable, "dhcp server is not running")
+		return
+	}
+	if len(parts) == 0 {
+		if allowMethods(w, r, parts, http.MethodGet) {
+			writeJSON(w, http.StatusOK, s.dhcpService.Leases())
+		}
+		return
+	}
+	mac, err := normalizeMAC(parts[0])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !allowMethods(w, r, parts[1:], http.MethodGet, http.MethodDelete) {
+		return
+	}
+	var lease RecordLease
+	var ok bool
+	if r.Method == http.MethodDelete {
+		lease, ok = s.dhcpService.RevokeLease(mac)
+	} else {
+		lease, ok = s.dhcpService.Lease(mac)
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no active lease for %s", mac))
+		return
+	}
+	if r.Method == http.MethodDelete {
+		s.Logger.Infof("[DHCP] lease of %s on %s revoked through the API", mac, lease.IPAddress)
+	}
+	writeJSON(w, http.StatusOK, lease)
+}
+
+// serveTransferAPI handles /api/v1/transfers/tftp and /api/v1/transfers/http.
+func (s *Service) serveTransferAPI(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 0 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if !allowMethods(w, r, parts[1:], http.MethodGet) {
+		return
+	}
+	switch parts[0] {
+	case "tftp":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"active": s.ActiveTFTPTransfers(),
+			"recent": s.RecentTFTPTransfers(),
+		})
+	case "http":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"active": s.ActiveHTTPTransfers(),
+			"recent": s.RecentHTTPTransfers(),
+		})
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// serveTemplateAPI handles /api/v1/templates/render.
+func (s *Service) serveTemplateAPI(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 0 || parts[0] != "render" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if !allowMethods(w, r, parts[1:], http.MethodPost) {
+		return
+	}
+	s.reloadLock.Lock()
+	err := s.LoadAndRenderTemplates()
+	s.reloadLock.Unlock()
+	if err != nil {
+		s.Logger.Errorf("[TMPL] rendering requested through the API failed: %s", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "rendered"})
+}
+
+// runtimeConfig returns the configuration in use, laid out like the config
+// file. The API token is not included.
+func (s *Service) runtimeConfig() map[string]interface{} {
+	cfg := s.settings()
+	return map[string]interface{}{
+		"config_file": s.ConfigFile,
+		"global": map[string]interface{}{
+			"ip_address":       cfg.ServiceIP,
+			"doc_root":         s.DocRoot,
+			"log_file_path":    s.LogFilePath,
+			"log_file_name":    s.LogFileName,
+			"shutdown_timeout": cfg.ShutdownTimeout.Seconds(),
+			"watch_config":     s.WatchConfig,
+		},
+		"pxe": map[string]interface{}{
+			"listen_ip":        s.ListenIP,
+			"http_port":        s.HTTPPort,
+			"http_root":        s.HTTPRoot,
+			"tftp_port":        s.TFTPPort,
+			"tftp_root":        s.TFTPRoot,
+			"dhcp_port":        s.DHCPPort,
+			"start_ip":         cfg.IPRangeStart,
+			"end_ip":           cfg.IPRangeEnd,
+			"netmask":          cfg.NetMask,
+			"router":           cfg.Router,
+			"dns_server":       cfg.DNSServer,
+			"tftp_server_name": cfg.TFTPServerName,
+			"pxe_file":         cfg.PXEBootImage,
+			"ipxe_file":        cfg.IPXEBootScript,
+			"enable_ipxe":      cfg.EnableIPXE,
+			"dynamic_boot":     cfg.DynamicBoot,
+			"lease_file":       s.LeaseFile,
+		},
+		"cache": map[string]interface{}{
+			"size":    s.CacheSize,
+			"preload": s.CachePreload,
+		},
+		"iso": s.ISOMounts,
+		"tftp": map[string]interface{}{
+			"timeout":       s.TFTPTimeout.Seconds(),
+			"stall_timeout": s.TFTPStallTimeout.Seconds(),
+			"history_size":  s.TFTPHistorySize,
+		},
+		"http": map[string]interface{}{
+			"history_size": s.HTTPHistorySize,
+		},
+		"templates": map[string]interface{}{
+			"mode": cfg.TemplateMode,
+		},
+		"grub": map[string]interface{}{
+			"efi_file":          cfg.GrubEFIFile,
+			"secure_boot_class": cfg.SecureBootClass,
+			"secure_boot_file":  cfg.SecureBootFile,
+		},
+		"secrets": map[string]interface{}{
+			"file":           cfg.SecretsFile,
+			"env_prefix":     cfg.SecretsEnvPrefix,
+			"tokens":         cfg.SecretTokens,
+			"install_window": cfg.InstallWindow.Minutes(),
+			"names":          secretNames(cfg.secrets),
+		},
+		"profiles": s.inventory.Profiles(),
+		"catalog":  cfg.Catalog,
+		"ignition": map[string]interface{}{
+			"base": cfg.IgnitionBase,
+		},
+		"windows": map[string]interface{}{
+			"share":      cfg.WindowsShare,
+			"share_user": cfg.WindowsShareUser,
+		},
+		"inventory": map[string]interface{}{
+			"dir": cfg.InventoryDir,
+		},
+		"provision": map[string]interface{}{
+			"state_file":  s.StateFile,
+			"local_boot":  cfg.LocalBoot,
+			"events_dir":  s.EventsDir,
+			"events_keep": s.EventsKeep,
+		},
+		"api": map[string]interface{}{
+			"token_set": cfg.APIToken != "",
+		},
+		"log": map[string]interface{}{
+			"format":       cfg.Log.Format,
+			"level":        cfg.Log.Level,
+			"levels":       cfg.Log.Levels,
+			"max_size":     cfg.Log.MaxSize,
+			"rotate_every": cfg.Log.RotateEvery.Hours(),
+			"max_backups":  cfg.Log.MaxBackups,
+			"max_age":      cfg.Log.MaxAge.Hours() / 24,
+		},
+		"notify": map[string]interface{}{
+			"audit_file": s.AuditFile,
+			"queue_size": s.EventQueueSize,
+			"webhooks":   webhookURLs(s.Webhooks),
+		},
+	}
+}
+
+// webhookURLs lists the webhooks without their secrets.
+func webhookURLs(hooks []WebhookConfig) []map[string]interface{} {
+	urls := []map[string]interface{}{}
+	for _, hook := range hooks {
+		urls = append(urls, map[string]interface{}{"url": hook.URL, "topics": hook.Topics})
+	}
+	return urls
+}
+
+// RemoteRearm asks the pxesrv daemon running with this configuration to
+// re-arm a host for reinstall.
+func (s *Service) RemoteRearm(mac string) (*HostStatus, error) {
+	mac, err := normalizeMAC(mac)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.nextServer()+apiPrefix+"hosts/"+mac+"/rearm", nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.APIToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.APIToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct{ Error string }
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return nil, fmt.Errorf("%s: %s", resp.Status, apiErr.Error)
+	}
+	var status HostStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
@@ -0,0 +1,328 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// bootScriptPath is the HTTP path of the per-host iPXE boot script.
+const bootScriptPath = "/boot"
+
+// bootScriptQuery is appended to bootScriptPath in the DHCP boot file name;
+// iPXE expands the settings before fetching the script.
+const bootScriptQuery = "?mac=${net0/mac}&uuid=${uuid}&serial=${serial}&arch=${buildarch}&platform=${platform}"
+
+var bootScriptTemplate = template.Must(template.New("boot.ipxe").Parse(`#!ipxe
+echo pxesrv: booting {{.Host.MAC}} with profile {{.Profile.Name}}
+kernel {{.Kernel}} {{.Cmdline}}
+{{- if .Initrd}}
+initrd {{.Initrd}}
+{{- end}}
+{{- range .Wimboot}}
+initrd -n {{.Name}} {{.URL}}
+{{- end}}
+boot
+`))
+
+// bootScriptData is the data available to boot script and cmdline templates.
+type bootScriptData struct {
+	NextServer string
+	Host       Host
+	Profile    Profile
+	UUID       string
+	Arch       string
+	Kernel     string
+	Initrd     string
+	Kickstart  string
+	CloudInit  string     // NoCloud seed URL, for ds=nocloud-net;s={{.CloudInit}}
+	Ignition   string     // Ignition config URL, if the profile has one
+	Unattend   string     // URL of the files injected into Windows PE, ending in a slash
+	Wimboot    []bootFile // files passed to wimboot, for Windows profiles
+	Cmdline    string
+
+	fromHost bool // requested by the host from its leased address: issue install tokens
+}
+
+// serveBootScript renders the iPXE script for the host identified by the
+// mac, uuid or serial query parameters. Unknown hosts, or hosts without a profile, get the
+// boot menu. The query is easy to forge, so only a request from the
+// address leased to the host moves its provisioning state and gets
+// install tokens.
+func (s *Service) serveBootScript(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	host, profile, ok := s.inventory.find(query.Get("mac"), query.Get("uuid"), query.Get("serial"))
+	if !ok || profile == nil {
+		if mac, err := normalizeMAC(query.Get("mac")); err == nil {
+			if first, _ := s.provision.Seen(mac); first && !ok {
+				client, _, _ := net.SplitHostPort(r.RemoteAddr)
+				s.bus.Publish(BusEvent{
+					Topic:   TopicUnknownHost,
+					MAC:     mac,
+					IP:      client,
+					Message: fmt.Sprintf("unknown host %s requested a boot script", mac),
+				})
+			}
+		}
+		s.serveBootMenu(w, r)
+		return
+	}
+	fromHost := strings.EqualFold(s.clientMAC(r.RemoteAddr), host.MAC)
+	if !fromHost {
+		s.Logger.Warningf("[HTTP] boot script for %s requested from %s, which is not its lease: state left alone, no install tokens",
+			host.MAC, r.RemoteAddr)
+	}
+	if installDone(s.provision.Get(host.MAC).State) {
+		if fromHost {
+			s.provision.Advance(host.MAC, StateLocalBoot)
+		}
+		s.Logger.Info(withFields(Fields{"mac": host.MAC}, "[HTTP] boot script for %s: installed, booting from local disk", host.MAC))
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(s.localBootScript(host, query.Get("platform")))
+		return
+	}
+
+	data := &bootScriptData{
+		NextServer: s.nextServer(),
+		Host:       *host,
+		Profile:    *profile,
+		UUID:       query.Get("uuid"),
+		Arch:       query.Get("arch"),
+		fromHost:   fromHost,
+	}
+	script, err := s.renderBootScript(data)
+	if err != nil {
+		s.Logger.Errorf("[HTTP] boot script for %s: %s", host.MAC, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if fromHost {
+		s.provision.Advance(host.MAC, StateInstalling)
+	}
+	s.Logger.Info(withFields(Fields{"mac": host.MAC, "profile": profile.Name},
+		"[HTTP] boot script for %s with profile %s", host.MAC, profile.Name))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(script)
+}
+
+// renderBootScript fills in the kernel, initrd and cmdline of data and
+// renders the iPXE script.
+func (s *Service) renderBootScript(data *bootScriptData) ([]byte, error) {
+	if err := s.renderCmdline(data); err != nil {
+		return nil, fmt.Errorf("profile %s %s", data.Profile.Name, err)
+	}
+	var buf bytes.Buffer
+	if err := bootScriptTemplate.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// renderCmdline fills in the kernel, initrd, kickstart and cmdline of data
+// from its profile. The kickstart, cloud-init, Ignition and unattend URLs
+// of a known host name the host and, with secrets.tokens, carry an install
+// token of it if the host asked itself, the cloud-init one only if the cmdline uses it; ignition.config.url is added to the cmdline of Ignition
+// profiles, and Windows profiles get the files wimboot boots.
+func (s *Service) renderCmdline(data *bootScriptData) error {
+	data.Kernel = bootFileURL(data.NextServer, data.Profile.Kernel)
+	if data.Profile.Initrd != "" {
+		data.Initrd = bootFileURL(data.NextServer, data.Profile.Initrd)
+	}
+	if data.Profile.Kickstart != "" {
+		data.Kickstart = bootFileURL(data.NextServer, data.Profile.Kickstart)
+		// Identify the host to the template even if the installer
+		// fetches the kickstart from an address it did not lease here.
+		query, err := s.hostQuery(data.Host.MAC, data.fromHost)
+		if err != nil {
+			return fmt.Errorf("kickstart token: %s", err)
+		}
+		data.Kickstart += query
+	}
+	if strings.Contains(data.Profile.Cmdline, ".CloudInit") {
+		seed, err := s.hostFileURL(data.NextServer, cloudInitPath, data.Host.MAC, data.fromHost)
+		if err != nil {
+			return fmt.Errorf("cloud-init token: %s", err)
+		}
+		data.CloudInit = seed
+	}
+	if data.Profile.Windows != "" {
+		unattend, err := s.hostFileURL(data.NextServer, unattendPath, data.Host.MAC, data.fromHost)
+		if err != nil {
+			return fmt.Errorf("unattend token: %s", err)
+		}
+		data.Unattend = unattend
+		data.Wimboot = windowsBootFiles(data.NextServer, unattend, data.Profile)
+	}
+	if data.Profile.Ignition != "" {
+		query, err := s.hostQuery(data.Host.MAC, data.fromHost)
+		if err != nil {
+			return fmt.Errorf("ignition token: %s", err)
+		}
+		data.Ignition = data.NextServer + ignitionPath + query
+	}
+	cmdline, err := template.New("cmdline").Funcs(templateFuncs(s.settings().SecretsEnvPrefix)).Parse(data.Profile.Cmdline)
+	if err != nil {
+		return fmt.Errorf("cmdline: %s", err)
+	}
+	var buf bytes.Buffer
+	if err := cmdline.Execute(&buf, data); err != nil {
+		return fmt.Errorf("cmdline: %s", err)
+	}
+	data.Cmdline = buf.String()
+	// The Ignition config is fetched from ignition.config.url, or by
+	// coreos-installer from coreos.inst.ignition_url if the cmdline sets it.
+	if data.Ignition != "" && !strings.Contains(data.Cmdline, "ignition.config.url=") &&
+		!strings.Contains(data.Cmdline, "coreos.inst.ignition_url=") {
+		data.Cmdline = strings.TrimSpace(data.Cmdline + " ignition.config.url=" + data.Ignition)
+	}
+	return nil
+}
+
+// hostQuery returns the query naming a known host in the URLs of its
+// kickstart and Ignition config, with an install token of the host if
+// secrets.tokens is set and token is true; it is empty for unknown hosts.
+func (s *Service) hostQuery(mac string, token bool) (string, error) {
+	if mac == "" {
+		return "", nil
+	}
+	cfg := s.settings()
+	query := "?mac=" + mac
+	if cfg.SecretTokens && token {
+		token, err := s.installTokens.issue(mac, cfg.InstallWindow)
+		if err != nil {
+			return "", err
+		}
+		query += "&token=" + token
+	}
+	return query, nil
+}
+
+// localBootScript returns an iPXE script that boots from the local disk.
+// EFI firmware continues with its next boot entry on exit, BIOS needs
+// sanboot of the first disk.
+func (s *Service) localBootScript(host *Host, platform string) []byte {
+	method := s.settings().LocalBoot
+	if method == "" || method == "auto" {
+		method = "sanboot"
+		if platform == "efi" {
+			method = "exit"
+		}
+	}
+	command := "exit"
+	if method == "sanboot" {
+		command = "sanboot --no-describe --drive 0x80 || exit"
+	}
+	return []byte(fmt.Sprintf("#!ipxe\necho pxesrv: %s is installed, booting from local disk\n%s\n", host.MAC, command))
+}
+
+var pxelinuxLocalBoot = []byte("default local\nlabel local\n  localboot 0\n")
+
+var pxelinuxTemplate = template.Must(template.New("pxelinux.cfg").Parse(`default {{.Profile.Name}}
+label {{.Profile.Name}}
+  kernel {{.Kernel}}
+  append {{if .Initrd}}initrd={{.Initrd}} {{end}}{{.Cmdline}}
+`))
+
+// renderHostBootConfig renders a pxelinux.cfg/01-<mac> file, or a GRUB
+// grub.cfg-01-<mac> file in any directory, booting a known host straight
+// into its profile. The file names are easy to guess, so only a TFTP
+// fetch from the address leased to the host, given as client, moves its
+// provisioning state and gets install tokens; HTTP fetches pass "".
+func (s *Service) renderHostBootConfig(filename, client string) ([]byte, bool) {
+	name := strings.TrimPrefix(filepath.ToSlash(filename), "/")
+	var mac string
+	var tmpl *template.Template
+	var localBoot []byte
+	switch {
+	case strings.HasPrefix(name, "pxelinux.cfg/01-"):
+		mac, tmpl, localBoot = strings.TrimPrefix(name, "pxelinux.cfg/01-"), pxelinuxTemplate, pxelinuxLocalBoot
+	case strings.HasPrefix(path.Base(name), grubHostConfigPrefix):
+		mac, tmpl, localBoot = strings.TrimPrefix(path.Base(name), grubHostConfigPrefix), grubTemplate, grubLocalBoot
+	default:
+		return nil, false
+	}
+	mac = strings.Replace(mac, "-", ":", -1)
+	host, profile, ok := s.inventory.lookup(mac)
+	if !ok || profile == nil {
+		return nil, false
+	}
+	if profile.Windows != "" {
+		// wimboot finds its files by the names the iPXE boot script gives them.
+		s.Logger.Warningf("[PXES] %s for %s: profile %s boots Windows, which needs iPXE and pxe.dynamic_boot", name, host.MAC, profile.Name)
+		return nil, false
+	}
+	advance := client != "" && strings.EqualFold(s.clientMAC(client), host.MAC)
+	if installDone(s.provision.Get(host.MAC).State) {
+		if advance {
+			s.provision.Advance(host.MAC, StateLocalBoot)
+		}
+		return localBoot, true
+	}
+	if advance {
+		s.provision.Advance(host.MAC, StateInstalling)
+	}
+	data := &bootScriptData{NextServer: s.nextServer(), Host: *host, Profile: *profile, fromHost: advance}
+	if err := s.renderCmdline(data); err != nil {
+		s.Logger.Errorf("[PXES] %s for %s: profile %s %s", name, host.MAC, profile.Name, err)
+		return nil, false
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		s.Logger.Errorf("[PXES] %s for %s: %s", name, host.MAC, err)
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// hostBootConfigHandler serves the per-host pxelinux and GRUB configs
+// over HTTP unless the file exists, and passes other requests to next.
+// Anyone can fetch them, so they leave the provisioning state alone.
+func (s *Service) hostBootConfigHandler(fileSystem http.FileSystem, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f, err := fileSystem.Open(r.URL.Path); err == nil {
+			f.Close()
+			next.ServeHTTP(w, r)
+			return
+		}
+		data, ok := s.renderHostBootConfig(r.URL.Path, "")
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(data)
+	})
+}
+
+// serveBootMenu serves the static iPXE menu script.
+func (s *Service) serveBootMenu(w http.ResponseWriter, r *http.Request) {
+	f, err := s.httpFileSystem.Open("/" + s.settings().IPXEBootScript)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.Copy(w, f)
+}
+
+// nextServer returns the base URL of the HTTP server.
+func (s *Service) nextServer() string {
+	return fmt.Sprintf("http://%s:%s", s.settings().ServiceIP, s.HTTPPort)
+}
+
+// bootFileURL returns path as a URL on the HTTP server unless it already
+// is a URL.
+func bootFileURL(nextServer, path string) string {
+	if strings.Contains(path, "://") {
+		return path
+	}
+	return nextServer + "/" + strings.TrimPrefix(path, "/")
+}
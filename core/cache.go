@@ -0,0 +1,189 @@
+package core
+
+import (
+	"bytes"
+	"container/list"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// fileCache is a size-bounded LRU cache of file contents shared by the
+// TFTP and HTTP servers. Entries are invalidated when the file's mtime or
+// size on disk changes. A file is read once however many clients ask for
+// it at the same time.
+type fileCache struct {
+	maxBytes  int64
+	usedBytes int64
+	entries   map[string]*list.Element
+	loading   map[string]*cacheLoad // reads in progress, by path
+	lru       *list.List
+	lock      sync.Mutex
+	hits      uint64
+	misses    uint64
+	read      func(path string) ([]byte, error)
+}
+
+type cacheEntry struct {
+	path string
+	data []byte
+	info os.FileInfo
+}
+
+// cacheLoad is a read of a file in progress. Callers asking for the same
+// version of the file wait for it instead of reading the file again.
+type cacheLoad struct {
+	info os.FileInfo
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// newFileCache creates a cache holding at most maxBytes of file content.
+func newFileCache(maxBytes int64) *fileCache {
+	return &fileCache{
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		loading:  make(map[string]*cacheLoad),
+		lru:      list.New(),
+		read:     ioutil.ReadFile,
+	}
+}
+
+// Get returns the contents of the file at path, reading it from disk if it
+// is not cached or has changed since it was cached; concurrent callers
+// share one read. Directories and files larger than the cache are not read
+// and are returned with nil data.
+func (c *fileCache) Get(path string) ([]byte, os.FileInfo, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir() || info.Size() > c.maxBytes {
+		return nil, info, nil
+	}
+
+	c.lock.Lock()
+	if element, ok := c.entries[path]; ok {
+		entry := element.Value.(*cacheEntry)
+		if sameFile(entry.info, info) {
+			c.lru.MoveToFront(element)
+			c.lock.Unlock()
+			atomic.AddUint64(&c.hits, 1)
+			return entry.data, entry.info, nil
+		}
+		c.remove(element)
+	}
+	atomic.AddUint64(&c.misses, 1)
+	if load, ok := c.loading[path]; ok && sameFile(load.info, info) {
+		c.lock.Unlock()
+		<-load.done
+		if load.err != nil {
+			return nil, nil, load.err
+		}
+		return load.data, load.info, nil
+	}
+	load := &cacheLoad{info: info, done: make(chan struct{})}
+	c.loading[path] = load
+	c.lock.Unlock()
+
+	load.data, load.err = c.read(path)
+	if load.err == nil {
+		c.add(path, load.data, info)
+	}
+	c.lock.Lock()
+	if c.loading[path] == load {
+		delete(c.loading, path)
+	}
+	c.lock.Unlock()
+	close(load.done)
+	if load.err != nil {
+		return nil, nil, load.err
+	}
+	return load.data, info, nil
+}
+
+// sameFile reports whether two stats of a file show the same version of
+// it, by modification time and size.
+func sameFile(a, b os.FileInfo) bool {
+	return a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
+
+// Stats returns the hit and miss counters.
+func (c *fileCache) Stats() (hits, misses uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+// Usage returns the number of cached bytes and entries.
+func (c *fileCache) Usage() (usedBytes int64, count int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.usedBytes, c.lru.Len()
+}
+
+// Preload reads the given files into the cache.
+func (c *fileCache) Preload(paths []string) error {
+	for _, path := range paths {
+		if _, _, err := c.Get(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *fileCache) add(path string, data []byte, info os.FileInfo) {
+	size := int64(len(data))
+	if size > c.maxBytes {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, ok := c.entries[path]; ok {
+		c.remove(element)
+	}
+	for c.usedBytes+size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+	entry := &cacheEntry{path: path, data: data, info: info}
+	c.entries[path] = c.lru.PushFront(entry)
+	c.usedBytes += size
+}
+
+func (c *fileCache) remove(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+	c.lru.Remove(element)
+	delete(c.entries, entry.path)
+	c.usedBytes -= int64(len(entry.data))
+}
+
+// cachedFileSystem serves regular files through a fileCache and falls back
+// to the underlying directory for everything else.
+type cachedFileSystem struct {
+	root  string
+	cache *fileCache
+}
+
+func (fs cachedFileSystem) Open(name string) (http.File, error) {
+	dir := http.Dir(fs.root)
+	path := filepath.Join(fs.root, filepath.FromSlash(filepath.Clean("/"+name)))
+	data, info, err := fs.cache.Get(path)
+	if err != nil || data == nil {
+		return dir.Open(name)
+	}
+	return &cachedFile{Reader: bytes.NewReader(data), info: info}, nil
+}
+
+// cachedFile is an http.File backed by cached file contents.
+type cachedFile struct {
+	*bytes.Reader
+	info os.FileInfo
+}
+
+func (f *cachedFile) Close() error { return nil }
+
+func (f *cachedFile) Readdir(count int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+
+func (f *cachedFile) Stat() (os.FileInfo, error) { return f.info, nil }
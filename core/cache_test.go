@@ -0,0 +1,165 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeCacheFile writes content to name in dir and returns its path.
+func writeCacheFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func cacheGet(t *testing.T, c *fileCache, path string) string {
+	t.Helper()
+	data, _, err := c.Get(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFileCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pxesrv-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := writeCacheFile(t, dir, "a", "aaaa")
+	b := writeCacheFile(t, dir, "b", "bbbb")
+	c := writeCacheFile(t, dir, "c", "cccc")
+
+	cache := newFileCache(10)
+	cacheGet(t, cache, a)
+	cacheGet(t, cache, b)
+	cacheGet(t, cache, a) // a is now more recently used than b
+	cacheGet(t, cache, c) // evicts b
+	if used, count := cache.Usage(); used != 8 || count != 2 {
+		t.Errorf("usage = %d bytes in %d entries, want 8 in 2", used, count)
+	}
+	if hits, misses := cache.Stats(); hits != 1 || misses != 3 {
+		t.Errorf("stats = %d hits, %d misses, want 1, 3", hits, misses)
+	}
+	cacheGet(t, cache, a)
+	cacheGet(t, cache, c)
+	if got := cacheGet(t, cache, b); got != "bbbb" {
+		t.Errorf("b = %q after eviction", got)
+	}
+	if hits, misses := cache.Stats(); hits != 3 || misses != 4 {
+		t.Errorf("stats = %d hits, %d misses, want 3, 4: b should have been evicted", hits, misses)
+	}
+}
+
+func TestFileCacheInvalidatesChangedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pxesrv-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeCacheFile(t, dir, "initrd.img", "one")
+	cache := newFileCache(100)
+	cacheGet(t, cache, path)
+
+	writeCacheFile(t, dir, "initrd.img", "three")
+	if got := cacheGet(t, cache, path); got != "three" {
+		t.Errorf("after a size change got %q, want three", got)
+	}
+	writeCacheFile(t, dir, "initrd.img", "fives")
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got := cacheGet(t, cache, path); got != "fives" {
+		t.Errorf("after an mtime change got %q, want fives", got)
+	}
+	if hits, misses := cache.Stats(); hits != 0 || misses != 3 {
+		t.Errorf("stats = %d hits, %d misses, want 0, 3", hits, misses)
+	}
+	if used, count := cache.Usage(); used != 5 || count != 1 {
+		t.Errorf("usage = %d bytes in %d entries, want 5 in 1", used, count)
+	}
+}
+
+func TestFileCacheSkipsFilesLargerThanTheCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pxesrv-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeCacheFile(t, dir, "big", "0123456789")
+	cache := newFileCache(4)
+	data, info, err := cache.Get(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data != nil || info == nil || info.Size() != 10 {
+		t.Errorf("Get of a file larger than the cache = %q, %v, want nil data and its info", data, info)
+	}
+	if used, count := cache.Usage(); used != 0 || count != 0 {
+		t.Errorf("usage = %d bytes in %d entries, want none", used, count)
+	}
+	if _, _, err := cache.Get(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("Get of a missing file: %v", err)
+	}
+}
+
+func TestFileCacheReadsOnceForConcurrentCallers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pxesrv-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeCacheFile(t, dir, "initrd.img", "initrd")
+	cache := newFileCache(100)
+	var reads int32
+	release := make(chan struct{})
+	cache.read = func(path string) ([]byte, error) {
+		atomic.AddInt32(&reads, 1)
+		<-release
+		return ioutil.ReadFile(path)
+	}
+
+	const clients = 20
+	var wg sync.WaitGroup
+	results := make([]string, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data, _, err := cache.Get(path)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = string(data)
+		}(i)
+	}
+	// Let the clients pile up behind the first read.
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if _, misses := cache.Stats(); misses == clients {
+			break
+		}
+	}
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&reads); n != 1 {
+		t.Errorf("%d reads for %d concurrent clients, want 1", n, clients)
+	}
+	for i, got := range results {
+		if got != "initrd" {
+			t.Errorf("client %d got %q", i, got)
+		}
+	}
+	if used, count := cache.Usage(); used != 6 || count != 1 {
+		t.Errorf("usage = %d bytes in %d entries, want 6 in 1", used, count)
+	}
+}
@@ -0,0 +1,136 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// CatalogEntry is an operating system of the boot menus. The iPXE and
+// pxelinux menu templates list the entries as .Catalog.
+type CatalogEntry struct {
+	ID        string `mapstructure:"id" json:"id"`               // menu item name
+	Label     string `mapstructure:"label" json:"label"`         // menu item text, the ID if empty
+	Kernel    string `mapstructure:"kernel" json:"kernel"`       // kernel path below the HTTP root, or a full URL
+	Initrd    string `mapstructure:"initrd" json:"initrd"`       // initrd path below the HTTP root, or a full URL
+	Cmdline   string `mapstructure:"cmdline" json:"cmdline"`     // kernel command line, may use {{.NextServer}} and {{.Kickstart}}
+	Kickstart string `mapstructure:"kickstart" json:"kickstart"` // kickstart/preseed path below the HTTP root
+	Arch      string `mapstructure:"arch" json:"arch"`           // x86_64, i386 or arm64; empty boots on any
+	Enabled   *bool  `mapstructure:"enabled" json:"enabled"`     // defaults to true
+}
+
+// catalogArchs are the architectures of catalog entries; they are named
+// like the iPXE build architectures.
+var catalogArchs = []string{"x86_64", "i386", "arm64"}
+
+// catalogID matches the IDs usable as iPXE and pxelinux labels.
+var catalogID = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// enabled reports whether the entry is listed in the menus.
+func (e CatalogEntry) enabled() bool {
+	return e.Enabled == nil || *e.Enabled
+}
+
+// validateCatalog checks that every entry has a unique ID, a kernel, a
+// known architecture and a cmdline that parses.
+func validateCatalog(catalog []CatalogEntry, secretsEnvPrefix string) error {
+	ids := make(map[string]bool, len(catalog))
+	for i, e := range catalog {
+		if !catalogID.MatchString(e.ID) {
+			return fmt.Errorf("catalog[%d]: id %q must be letters, digits, '-', '_' or '.'", i, e.ID)
+		}
+		if ids[e.ID] {
+			return fmt.Errorf("catalog: duplicate id %q", e.ID)
+		}
+		ids[e.ID] = true
+		if e.Kernel == "" {
+			return fmt.Errorf("catalog %s: kernel is required", e.ID)
+		}
+		if e.Arch != "" && !stringInSlice(e.Arch, catalogArchs) {
+			return fmt.Errorf("catalog %s: arch %q is not one of %s", e.ID, e.Arch, strings.Join(catalogArchs, ", "))
+		}
+		if _, err := template.New("cmdline").Funcs(templateFuncs(secretsEnvPrefix)).Parse(e.Cmdline); err != nil {
+			return fmt.Errorf("catalog %s cmdline: %s", e.ID, err)
+		}
+	}
+	return nil
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// MenuEntry is a catalog entry as the menu templates see it: the kernel,
+// initrd and kickstart are URLs and the cmdline is rendered.
+type MenuEntry struct {
+	ID        string
+	Label     string
+	Kernel    string
+	Initrd    string
+	Kickstart string
+	Cmdline   string
+	Arch      string
+}
+
+// menuEntries returns the enabled catalog entries whose kernel exists.
+// hidden explains why each of the other enabled entries is left out.
+func (s *Service) menuEntries() (entries []MenuEntry, hidden []string) {
+	for _, e := range s.settings().Catalog {
+		if !e.enabled() {
+			continue
+		}
+		if !s.bootFileExists(e.Kernel) {
+			hidden = append(hidden, fmt.Sprintf("%s: kernel %s not found", e.ID, e.Kernel))
+			continue
+		}
+		data := &bootScriptData{
+			NextServer: s.nextServer(),
+			Profile:    Profile{Name: e.ID, Kernel: e.Kernel, Initrd: e.Initrd, Cmdline: e.Cmdline, Kickstart: e.Kickstart},
+			Arch:       e.Arch,
+		}
+		if err := s.renderCmdline(data); err != nil {
+			hidden = append(hidden, fmt.Sprintf("%s: %s", e.ID, err))
+			continue
+		}
+		label := e.Label
+		if label == "" {
+			label = e.ID
+		}
+		entries = append(entries, MenuEntry{
+			ID:        e.ID,
+			Label:     label,
+			Kernel:    data.Kernel,
+			Initrd:    data.Initrd,
+			Kickstart: data.Kickstart,
+			Cmdline:   data.Cmdline,
+			Arch:      e.Arch,
+		})
+	}
+	return entries, hidden
+}
+
+// bootFileExists reports whether the boot file name, a path below the HTTP
+// root or in an ISO image served there, exists. URLs are assumed to.
+func (s *Service) bootFileExists(name string) bool {
+	if strings.Contains(name, "://") {
+		return true
+	}
+	if img, inner, ok := findISOMount(s.isoMounts, name); ok {
+		f, err := img.Open(inner)
+		if err != nil {
+			return false
+		}
+		f.Close()
+		return true
+	}
+	info, err := os.Stat(filepath.Join(s.DocRoot, s.HTTPRoot, filepath.FromSlash(name)))
+	return err == nil && !info.IsDir()
+}
@@ -0,0 +1,17 @@
+package core
+
+// cloudInitPath is the HTTP path of the cloud-init NoCloud datasource.
+// Installers booted with ds=nocloud-net;s=<NextServer>/cloud-init/<mac>/
+// fetch meta-data, user-data and vendor-data below it; with secrets.tokens
+// a token of the host follows the MAC address. Without a MAC address the
+// client is found by its lease or reservation.
+const cloudInitPath = "/cloud-init/"
+
+// cloudInitTemplateDir holds the templates of the NoCloud files, below the
+// templates directory. They are rendered for each host on request and
+// never into netboot; cloud-init/<profile>/<file>.tmpl overrides
+// cloud-init/<file>.tmpl for the hosts of a profile.
+const cloudInitTemplateDir = "cloud-init"
+
+// cloudInitFiles are the files of the NoCloud datasource.
+var cloudInitFiles = []string{"meta-data", "user-data", "vendor-data"}
@@ -0,0 +1,335 @@
+package core
+
+import (
+	"net/http"
+)
+
+// dashboardPath is the HTTP path of the web dashboard.
+const dashboardPath = "/ui/"
+
+// serveDashboard serves the dashboard page. It is a static page that reads
+// everything it shows from the API, so it needs no access control of its
+// own: the API token is entered in the page and kept by the browser.
+func (s *Service) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != dashboardPath {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Write([]byte(dashboardHTML))
+}
+
+// dashboardHTML is the dashboard page with its style and script inline.
+const dashboardHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>pxesrv</title>
+<style>
+body { font: 14px/1.4 -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 0; color: #222; background: #f4f5f7; }
+header { background: #263238; color: #fff; padding: 10px 20px; display: flex; align-items: center; gap: 16px; }
+header h1 { font-size: 18px; margin: 0; flex: 1; }
+header input { width: 220px; }
+main { padding: 10px 20px; }
+section { background: #fff; border: 1px solid #dde; border-radius: 4px; margin-bottom: 16px; padding: 8px 12px; }
+h2 { font-size: 15px; margin: 4px 0 8px; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #eee; white-space: nowrap; }
+th { color: #666; font-weight: normal; }
+td.msg { white-space: normal; }
+tr.selected { background: #e3f2fd; }
+.state { padding: 1px 6px; border-radius: 3px; background: #eceff1; }
+.state.installing { background: #fff3e0; }
+.state.installed, .state.localboot, .state.complete { background: #e8f5e9; }
+.state.failed, .state.aborted { background: #ffebee; }
+.bar { width: 120px; height: 8px; background: #eceff1; border-radius: 4px; display: inline-block; vertical-align: middle; }
+.bar div { height: 8px; background: #43a047; border-radius: 4px; }
+#status { font-size: 12px; color: #b0bec5; }
+#status.error { color: #ff8a80; }
+pre { background: #263238; color: #eceff1; padding: 8px; max-height: 300px; overflow: auto; }
+button { cursor: pointer; }
+.empty { color: #999; }
+</style>
+</head>
+<body>
+<header>
+  <h1>pxesrv</h1>
+  <span id="status"></span>
+  <input id="token" type="password" placeholder="API token">
+</header>
+<main>
+  <section>
+    <h2>Hosts</h2>
+    <table>
+      <thead><tr><th>MAC</th><th>Hostname</th><th>Address</th><th>Profile</th><th>State</th><th>Progress</th><th>Last event</th><th></th></tr></thead>
+      <tbody id="hosts"></tbody>
+    </table>
+  </section>
+  <section id="events-section" hidden>
+    <h2>Events of <span id="events-mac"></span></h2>
+    <table>
+      <thead><tr><th>Time</th><th>Type</th><th>Stage</th><th>Progress</th><th>Message</th><th>From</th></tr></thead>
+      <tbody id="events"></tbody>
+    </table>
+    <pre id="event-log" hidden></pre>
+  </section>
+  <section>
+    <h2>Leases of unknown hosts</h2>
+    <table>
+      <thead><tr><th>MAC</th><th>Address</th><th>Expires</th><th>Profile</th><th></th></tr></thead>
+      <tbody id="leases"></tbody>
+    </table>
+  </section>
+  <section>
+    <h2>Downloads</h2>
+    <table>
+      <thead><tr><th></th><th>Client</th><th>File</th><th>Progress</th><th>Outcome</th><th>Started</th><th>Duration</th></tr></thead>
+      <tbody id="downloads"></tbody>
+    </table>
+  </section>
+</main>
+<script>
+(function () {
+  "use strict";
+  var api = "/api/v1/";
+  var tokenInput = document.getElementById("token");
+  var profiles = [];
+  var selected = "";
+  var events = [];
+
+  tokenInput.value = localStorage.getItem("pxesrv-token") || "";
+  tokenInput.addEventListener("change", function () {
+    localStorage.setItem("pxesrv-token", tokenInput.value);
+    refresh();
+  });
+
+  function request(method, path, body) {
+    var options = { method: method, headers: {} };
+    if (tokenInput.value) {
+      options.headers["Authorization"] = "Bearer " + tokenInput.value;
+    }
+    if (body !== undefined) {
+      options.headers["Content-Type"] = "application/json";
+      options.body = JSON.stringify(body);
+    }
+    return fetch(api + path, options).then(function (resp) {
+      if (resp.status === 204) {
+        return null;
+      }
+      return resp.json().then(function (data) {
+        if (!resp.ok) {
+          throw new Error(data.error || resp.statusText);
+        }
+        return data;
+      });
+    });
+  }
+
+  function esc(value) {
+    return String(value === undefined || value === null ? "" : value).replace(/[&<>"']/g, function (c) {
+      return { "&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;" }[c];
+    });
+  }
+
+  function time(value) {
+    if (!value || value.indexOf("0001-") === 0) {
+      return "";
+    }
+    return new Date(value).toLocaleString();
+  }
+
+  function duration(start, end) {
+    var ms = (end && end.indexOf("0001-") !== 0 ? new Date(end) : new Date()) - new Date(start);
+    return (ms / 1000).toFixed(1) + " s";
+  }
+
+  function bytes(n) {
+    var units = ["B", "KB", "MB", "GB"];
+    var i = 0;
+    while (n >= 1024 && i < units.length - 1) {
+      n /= 1024;
+      i++;
+    }
+    return n.toFixed(i ? 1 : 0) + " " + units[i];
+  }
+
+  function bar(percent) {
+    return '<span class="bar"><div style="width:' + Math.max(0, Math.min(100, percent)) + '%"></div></span> ' + percent + "%";
+  }
+
+  function profileSelect(mac, current) {
+    var html = '<select data-mac="' + esc(mac) + '"><option value="">(none)</option>';
+    profiles.forEach(function (name) {
+      html += "<option" + (name === current ? " selected" : "") + ">" + esc(name) + "</option>";
+    });
+    return html + "</select>";
+  }
+
+  function progress(host) {
+    switch (host.status.state) {
+    case "installed":
+    case "localboot":
+      return 100;
+    case "installing":
+      return host.last_event && host.last_event.progress ? host.last_event.progress : 0;
+    }
+    return 0;
+  }
+
+  function renderHosts(hosts) {
+    var rows = hosts.map(function (host) {
+      var address = host.lease ? host.lease.ip_address : (host.ip || "");
+      var last = host.last_event ? esc(host.last_event.type) + ": " + esc(host.last_event.message || host.last_event.stage) : "";
+      return '<tr class="' + (host.mac === selected ? "selected" : "") + '">' +
+        "<td>" + esc(host.mac) + "</td>" +
+        "<td>" + esc(host.hostname) + "</td>" +
+        "<td>" + esc(address) + "</td>" +
+        "<td>" + profileSelect(host.mac, host.profile) + "</td>" +
+        '<td><span class="state ' + esc(host.status.state) + '">' + esc(host.status.state) + "</span></td>" +
+        "<td>" + bar(progress(host)) + "</td>" +
+        '<td class="msg">' + last + "</td>" +
+        '<td><button data-action="rearm" data-mac="' + esc(host.mac) + '">Re-arm</button> ' +
+        '<button data-action="events" data-mac="' + esc(host.mac) + '">Events</button></td></tr>';
+    });
+    document.getElementById("hosts").innerHTML = rows.join("") || '<tr><td colspan="8" class="empty">no hosts</td></tr>';
+  }
+
+  function renderLeases(leases, hosts) {
+    var known = {};
+    hosts.forEach(function (host) { known[host.mac] = true; });
+    var rows = leases.filter(function (lease) { return !known[lease.mac_address]; }).map(function (lease) {
+      return "<tr><td>" + esc(lease.mac_address) + "</td>" +
+        "<td>" + esc(lease.ip_address) + "</td>" +
+        "<td>" + esc(time(lease.expires)) + "</td>" +
+        "<td>" + profileSelect(lease.mac_address, "") + "</td>" +
+        '<td><button data-action="revoke" data-mac="' + esc(lease.mac_address) + '">Revoke</button></td></tr>';
+    });
+    document.getElementById("leases").innerHTML = rows.join("") || '<tr><td colspan="5" class="empty">no leases</td></tr>';
+  }
+
+  function renderDownloads(tftp, http) {
+    var all = [];
+    [["TFTP", tftp], ["HTTP", http]].forEach(function (proto) {
+      proto[1].active.concat(proto[1].recent).forEach(function (t) {
+        all.push({ proto: proto[0], t: t });
+      });
+    });
+    all.sort(function (a, b) { return new Date(b.t.start) - new Date(a.t.start); });
+    var rows = all.slice(0, 25).map(function (d) {
+      var t = d.t;
+      var done = t.size > 0 ? bar(Math.round(100 * t.bytes / t.size)) : "";
+      return "<tr><td>" + d.proto + "</td>" +
+        "<td>" + esc(t.client) + "</td>" +
+        "<td>" + esc(t.file || t.path) + "</td>" +
+        "<td>" + done + " " + bytes(t.bytes) + "</td>" +
+        '<td><span class="state ' + esc(t.outcome) + '">' + esc(t.outcome) + (t.stalled ? " (stalled)" : "") + "</span>" + (t.retransmits ? " " + t.retransmits + " retransmits" : "") + "</td>" +
+        "<td>" + esc(time(t.start)) + "</td>" +
+        "<td>" + duration(t.start, t.end) + "</td></tr>";
+    });
+    document.getElementById("downloads").innerHTML = rows.join("") || '<tr><td colspan="7" class="empty">no downloads</td></tr>';
+  }
+
+  function renderEvents() {
+    document.getElementById("events-section").hidden = !selected;
+    document.getElementById("events-mac").textContent = selected;
+    var rows = events.slice().reverse().map(function (e, i) {
+      return '<tr data-event="' + (events.length - 1 - i) + '">' +
+        "<td>" + esc(time(e.time)) + "</td>" +
+        '<td><span class="state ' + (e.type === "failure" ? "failed" : "") + '">' + esc(e.type) + "</span></td>" +
+        "<td>" + esc(e.stage) + "</td>" +
+        "<td>" + (e.progress ? e.progress + "%" : "") + "</td>" +
+        '<td class="msg">' + esc(e.message) + (e.log ? ' <button data-action="log">log</button>' : "") + "</td>" +
+        "<td>" + esc(e.client) + "</td></tr>";
+    });
+    document.getElementById("events").innerHTML = rows.join("") || '<tr><td colspan="6" class="empty">no events</td></tr>';
+  }
+
+  function setStatus(text, error) {
+    var status = document.getElementById("status");
+    status.textContent = text;
+    status.className = error ? "error" : "";
+  }
+
+  function refresh() {
+    Promise.all([
+      request("GET", "config"),
+      request("GET", "hosts"),
+      request("GET", "leases").catch(function () { return []; }),
+      request("GET", "transfers/tftp"),
+      request("GET", "transfers/http"),
+      selected ? request("GET", "hosts/" + selected + "/events") : Promise.resolve([])
+    ]).then(function (r) {
+      profiles = Object.keys(r[0].profiles || {}).sort();
+      events = r[5];
+      renderHosts(r[1]);
+      renderLeases(r[2], r[1]);
+      renderDownloads(r[3], r[4]);
+      renderEvents();
+      setStatus("updated " + new Date().toLocaleTimeString());
+    }).catch(function (err) {
+      setStatus(err.message, true);
+    });
+  }
+
+  function act(promise) {
+    promise.then(refresh).catch(function (err) {
+      setStatus(err.message, true);
+      alert(err.message);
+    });
+  }
+
+  document.addEventListener("change", function (e) {
+    var mac = e.target.getAttribute("data-mac");
+    if (e.target.tagName !== "SELECT" || !mac) {
+      return;
+    }
+    var profile = e.target.value;
+    if (e.target.closest("#leases")) {
+      act(request("POST", "hosts", { mac: mac, profile: profile }));
+      return;
+    }
+    act(request("GET", "hosts/" + mac).then(function (host) {
+      return request("PUT", "hosts/" + mac, {
+        uuid: host.uuid, serial: host.serial, hostname: host.hostname,
+        ip: host.ip, profile: profile, metadata: host.metadata
+      });
+    }));
+  });
+
+  document.addEventListener("click", function (e) {
+    var action = e.target.getAttribute("data-action");
+    var mac = e.target.getAttribute("data-mac");
+    switch (action) {
+    case "rearm":
+      if (confirm("Reinstall " + mac + " on its next boot?")) {
+        act(request("POST", "hosts/" + mac + "/rearm"));
+      }
+      break;
+    case "revoke":
+      if (confirm("Revoke the lease of " + mac + "?")) {
+        act(request("DELETE", "leases/" + mac));
+      }
+      break;
+    case "events":
+      selected = selected === mac ? "" : mac;
+      document.getElementById("event-log").hidden = true;
+      refresh();
+      break;
+    case "log":
+      var log = document.getElementById("event-log");
+      log.textContent = events[e.target.closest("tr").getAttribute("data-event")].log;
+      log.hidden = false;
+      break;
+    }
+  });
+
+  refresh();
+  setInterval(refresh, 5000);
+})();
+</script>
+</body>
+</html>
+`
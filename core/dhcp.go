@@ -3,6 +3,7 @@ package core
 import (
 	"fmt"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -10,29 +11,50 @@ import (
 	"github.com/op/go-logging"
 )
 
-func (s *Service) serveDHCP(conn dhcp.ServeConn) error {
-	ipxeBootScript := fmt.Sprintf("http://%s:%s/%s", s.ServiceIP, s.HTTPPort, s.IPXEBootScript)
+// newDHCPService creates the DHCP handler from the service configuration.
+func (s *Service) newDHCPService() *DHCPService {
+	cfg := s.settings()
+	ipxeBootScript := fmt.Sprintf("%s/%s", s.nextServer(), cfg.IPXEBootScript)
+	if cfg.DynamicBoot {
+		ipxeBootScript = s.nextServer() + bootScriptPath + bootScriptQuery
+	}
 	dhcpService := &DHCPService{
-		ServiceIP:          net.ParseIP(s.ServiceIP),
-		IPRangeStart:       net.ParseIP(s.IPRangeStart),
-		IPRangeEnd:         net.ParseIP(s.IPRangeEnd),
+		ServiceIP:          net.ParseIP(cfg.ServiceIP),
+		IPRangeStart:       net.ParseIP(cfg.IPRangeStart),
+		IPRangeEnd:         net.ParseIP(cfg.IPRangeEnd),
 		leasesByMACAddress: make(map[string]*RecordLease),
+		leasesByIP:         make(map[string]*RecordLease),
 		LeaseDuration:      24 * time.Hour,
-		EnableIPXE:         s.EnableIPXE,
+		EnableIPXE:         cfg.EnableIPXE,
+		TFTPServerName:     cfg.TFTPServerName,
 		stateLock:          &sync.Mutex{},
-		PXEBootImage:       s.PXEBootImage,
+		PXEBootImage:       cfg.PXEBootImage,
 		IPXEBootScript:     ipxeBootScript,
+		GrubEFIFile:        cfg.GrubEFIFile,
+		SecureBootClass:    cfg.SecureBootClass,
+		SecureBootFile:     cfg.SecureBootFile,
 		log:                s.Logger,
+		inventory:          s.inventory,
+		provision:          s.provision,
+		metrics:            s.metrics,
+		bus:                s.bus,
 		dhcpOptions: dhcp.Options{
-			dhcp.OptionSubnetMask:       net.ParseIP(s.NetMask).To4(),
-			dhcp.OptionRouter:           []byte(s.Router),
-			dhcp.OptionDomainNameServer: []byte(s.DNSServer),      // Presuming Server is also your DNS server
-			dhcp.OptionTFTPServerName:   []byte(s.TFTPServerName), // tftp_files server address
+			dhcp.OptionSubnetMask:       net.ParseIP(cfg.NetMask).To4(),
+			dhcp.OptionRouter:           []byte(cfg.Router),
+			dhcp.OptionDomainNameServer: []byte(cfg.DNSServer),      // Presuming Server is also your DNS server
+			dhcp.OptionTFTPServerName:   []byte(cfg.TFTPServerName), // tftp_files server address
 		},
 	}
+	return dhcpService
+}
+
+func (s *Service) serveDHCP(conn dhcp.ServeConn) error {
 	s.Logger.Infof("[DHCP] starting dhcp server on port %s(UDP)", s.DHCPPort)
 
-	if err := dhcp.Serve(conn, dhcpService); err != nil {
+	if err := dhcp.Serve(conn, s.dhcpService); err != nil {
+		if s.isShuttingDown() {
+			return nil
+		}
 		s.Logger.Errorf("DHCP server shut down: %s", err)
 		return err
 	}
@@ -49,15 +71,47 @@ type DHCPService struct {
 	TFTPServerName     string
 	PXEBootImage       string // PXE boot file (TFTP)
 	IPXEBootScript     string // iPXE boot script (HTTP)
+	GrubEFIFile        string // boot file of x86-64 UEFI clients, empty gives them PXEBootImage
+	SecureBootClass    string // user or vendor class of the clients booting SecureBootFile
+	SecureBootFile     string // shim of the Secure Boot clients (TFTP)
 	EnableIPXE         bool
 	dhcpOptions        dhcp.Options
 	leasesByMACAddress map[string]*RecordLease
+	leasesByIP         map[string]*RecordLease // the latest lease of each address
+	inventory          *inventory              // known hosts and their reserved addresses
+	provision          *provisionTracker       // provisioning state of the hosts
+	metrics            *metrics
+	bus                *eventBus
 	stateLock          *sync.Mutex
+	configLock         sync.RWMutex    // held while serving, taken for writing on reload
 	log                *logging.Logger //default log
 }
 
+// updateConfig applies the configuration of c to the running service
+// without touching its leases.
+func (s *DHCPService) updateConfig(c *DHCPService) {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	s.ServiceIP = c.ServiceIP
+	s.IPRangeStart = c.IPRangeStart
+	s.IPRangeEnd = c.IPRangeEnd
+	s.LeaseDuration = c.LeaseDuration
+	s.TFTPServerName = c.TFTPServerName
+	s.PXEBootImage = c.PXEBootImage
+	s.IPXEBootScript = c.IPXEBootScript
+	s.GrubEFIFile = c.GrubEFIFile
+	s.SecureBootClass = c.SecureBootClass
+	s.SecureBootFile = c.SecureBootFile
+	s.EnableIPXE = c.EnableIPXE
+	s.dhcpOptions = c.dhcpOptions
+}
+
 // ServeDHCP handles an incoming DHCP request.
 func (s *DHCPService) ServeDHCP(request dhcp.Packet, msgType dhcp.MessageType, requestOptions dhcp.Options) (response dhcp.Packet) {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+
 	switch msgType {
 	case dhcp.Discover:
 		response = s.handleDiscover(request, requestOptions)
@@ -68,10 +122,11 @@ func (s *DHCPService) ServeDHCP(request dhcp.Packet, msgType dhcp.MessageType, r
 	case dhcp.Release:
 		response = s.handleRelease(request, requestOptions)
 	default:
-		s.log.Infof("[TXN: %s] Ignoring unhandled DHCP message type (%s).",
+		s.log.Info(withFields(Fields{"mac": request.CHAddr().String(), "type": msgType.String()},
+			"[TXN: %s] Ignoring unhandled DHCP message type (%s).",
 			getTransactionID(request),
 			msgType.String(),
-		)
+		))
 
 		response = s.replyNAK(request)
 	}
@@ -79,6 +134,7 @@ func (s *DHCPService) ServeDHCP(request dhcp.Packet, msgType dhcp.MessageType, r
 	if response != nil {
 		response.PadToMinSize() // Must add padding AFTER all other options.
 	}
+	s.metrics.dhcpMessages.Inc(strings.ToLower(msgType.String()), dhcpOutcome(response))
 
 	return
 }
@@ -88,24 +144,51 @@ func (s *DHCPService) handleDiscover(request dhcp.Packet, requestOptions dhcp.Op
 	transactionID := getTransactionID(request)
 	clientMACAddress := request.CHAddr().String()
 
-	s.log.Infof("[TXN: %s] Discover message from client with MAC address %s (IP '%s').",
+	s.log.Info(withFields(Fields{"mac": clientMACAddress, "ip": request.CIAddr().String()},
+		"[TXN: %s] Discover message from client with MAC address %s (IP '%s').",
 		transactionID,
 		clientMACAddress,
 		request.CIAddr().String(),
-	)
+	))
+
+	host, _, known := s.inventory.find(clientMACAddress, getClientUUID(requestOptions), "")
+	if isPXEClient(requestOptions) {
+		if first, _ := s.provision.Seen(clientMACAddress); first && !known {
+			s.bus.Publish(BusEvent{
+				Topic:   TopicUnknownHost,
+				MAC:     clientMACAddress,
+				Message: fmt.Sprintf("unknown host %s PXE booted", clientMACAddress),
+				Data:    map[string]interface{}{"uuid": getClientUUID(requestOptions)},
+			})
+		}
+	}
 
 	var targetIP net.IP
 
-	existingLease, ok := s.leasesByMACAddress[clientMACAddress]
-	if ok {
+	existingLease, ok := s.leaseOf(clientMACAddress)
+	if known && host.IP != "" {
+		// Known host with a reserved address.
+		targetIP = net.ParseIP(host.IP).To4()
+		s.log.Info(withFields(Fields{"mac": clientMACAddress, "ip": host.IP, "hostname": host.Hostname},
+			"[TXN: %s] MAC address %s is known host '%s' with reserved IP '%s'.",
+			transactionID,
+			clientMACAddress,
+			host.Hostname,
+			host.IP,
+		))
+		if !ok || !existingLease.IPAddress.Equal(targetIP) {
+			s.reserveIP(clientMACAddress, targetIP)
+		}
+	} else if ok {
 		targetIP = existingLease.IPAddress
 	} else {
 		newRecordLease, err := s.createIP(clientMACAddress, s.IPRangeStart, s.IPRangeEnd)
 		if err != nil {
-			s.log.Infof("[TXN: %s] MAC address %s could not get a new available IP address (no reply will be sent).",
+			s.log.Info(withFields(Fields{"mac": clientMACAddress},
+				"[TXN: %s] MAC address %s could not get a new available IP address (no reply will be sent).",
 				transactionID,
 				clientMACAddress,
-			)
+			))
 			return s.noReply()
 		}
 		targetIP = newRecordLease.IPAddress
@@ -125,15 +208,16 @@ func (s *DHCPService) replyOffer(request dhcp.Packet, targetIP net.IP, requestOp
 		s.dhcpOptions.SelectOrderOrAll(requestOptions[dhcp.OptionParameterRequestList]),
 	)
 
-	s.log.Infof("[TXN: %s] Offer message to client with MAC address %s (IP '%s').",
+	s.log.Info(withFields(Fields{"mac": clientMACAddress, "ip": targetIP.String()},
+		"[TXN: %s] Offer message to client with MAC address %s (IP '%s').",
 		transactionID,
 		clientMACAddress,
 		targetIP.String(),
-	)
+	))
 
-	// Configure host name from server name.
+	// Configure host name from the inventory.
 	reply.AddOption(dhcp.OptionHostName,
-		[]byte(""),
+		[]byte(s.hostName(clientMACAddress, requestOptions)),
 	)
 
 	// Add DHCP options for PXE / iPXE, if required.
@@ -147,6 +231,15 @@ func (s *DHCPService) replyOffer(request dhcp.Packet, targetIP net.IP, requestOp
 	return reply
 }
 
+// hostName returns the inventory host name of a client, if it is known.
+func (s *DHCPService) hostName(clientMACAddress string, requestOptions dhcp.Options) string {
+	host, _, ok := s.inventory.find(clientMACAddress, getClientUUID(requestOptions), "")
+	if !ok {
+		return ""
+	}
+	return host.Hostname
+}
+
 // Create an empty reply packet (i.e. no reply should be sent)
 func (s *DHCPService) noReply() dhcp.Packet {
 	return dhcp.Packet{}
@@ -170,33 +263,36 @@ func (s *DHCPService) handleRequest(request dhcp.Packet, requestOptions dhcp.Opt
 	transactionID := getTransactionID(request)
 	clientMACAddress := request.CHAddr().String()
 
-	s.log.Infof("[TXN: %s] Request message from client with MAC address %s (IP '%s').",
+	s.log.Info(withFields(Fields{"mac": clientMACAddress, "ip": request.CIAddr().String()},
+		"[TXN: %s] Request message from client with MAC address %s (IP '%s').",
 		transactionID,
 		clientMACAddress,
 		request.CIAddr().String(),
-	)
+	))
 
 	// Is this a renewal?
-	existingLease, ok := s.leasesByMACAddress[clientMACAddress]
+	existingLease, ok := s.leaseOf(clientMACAddress)
 	if ok {
 		if !existingLease.IsExpired() {
-			s.log.Infof("[TXN: %s] Renew lease on IPv4 address %s for server %s and send ACK reply.",
+			s.log.Info(withFields(Fields{"mac": clientMACAddress, "ip": existingLease.IPAddress.String()},
+				"[TXN: %s] Renew lease on IPv4 address %s for server %s and send ACK reply.",
 				transactionID,
 				existingLease.IPAddress.String(),
 				clientMACAddress,
-			)
+			))
 
-			s.renewLease(existingLease)
+			s.renewLease(clientMACAddress)
 
 			return s.replyACK(request, existingLease.IPAddress, requestOptions)
 		}
 		// New lease
 		targetIP := existingLease.IPAddress
-		s.log.Infof("[TXN: %s] Create lease on IPv4 address %s for server (MAC address %s) and send ACK reply.",
+		s.log.Info(withFields(Fields{"mac": clientMACAddress, "ip": targetIP.String()},
+			"[TXN: %s] Create lease on IPv4 address %s for server (MAC address %s) and send ACK reply.",
 			transactionID,
 			targetIP.String(),
 			clientMACAddress,
-		)
+		))
 		newLease := s.createLease(clientMACAddress, targetIP)
 
 		return s.replyACK(request, newLease.IPAddress, requestOptions)
@@ -215,17 +311,28 @@ func (s *DHCPService) replyACK(request dhcp.Packet, targetIP net.IP, requestOpti
 		s.dhcpOptions.SelectOrderOrAll(requestOptions[dhcp.OptionParameterRequestList]),
 	)
 
-	s.log.Infof("[TXN: %s] ACK message to client with MAC address %s (IP '%s', Lease %d).",
+	s.log.Info(withFields(Fields{"mac": clientMACAddress, "ip": targetIP.String()},
+		"[TXN: %s] ACK message to client with MAC address %s (IP '%s', Lease %d).",
 		transactionID,
 		clientMACAddress,
 		targetIP.String(),
 		s.LeaseDuration,
-	)
+	))
+	hostName := s.hostName(clientMACAddress, requestOptions)
+	s.bus.Publish(BusEvent{
+		Topic:   TopicLease,
+		MAC:     clientMACAddress,
+		IP:      targetIP.String(),
+		Message: fmt.Sprintf("lease on %s granted to %s", targetIP, clientMACAddress),
+		Data: map[string]interface{}{
+			"hostname": hostName,
+			"duration": s.LeaseDuration.String(),
+			"pxe":      isPXEClient(requestOptions),
+		},
+	})
 
-	// Configure host name from server name.
-	reply.AddOption(dhcp.OptionHostName,
-		[]byte(""),
-	)
+	// Configure host name from the inventory.
+	reply.AddOption(dhcp.OptionHostName, []byte(hostName))
 
 	// Add DHCP options for PXE / iPXE, if required.
 	if s.EnableIPXE && isPXEClient(requestOptions) {
@@ -243,26 +350,29 @@ func (s *DHCPService) handleRelease(request dhcp.Packet, requestOptions dhcp.Opt
 	transactionID := getTransactionID(request)
 	clientMACAddress := request.CHAddr().String()
 
-	s.log.Infof("[TXN: %s] Release message from client with MAC address %s (IP '%s').",
+	s.log.Info(withFields(Fields{"mac": clientMACAddress, "ip": request.CIAddr().String()},
+		"[TXN: %s] Release message from client with MAC address %s (IP '%s').",
 		transactionID,
 		clientMACAddress,
 		request.CIAddr().String(),
-	)
+	))
 
-	existingLease, ok := s.leasesByMACAddress[clientMACAddress]
+	existingLease, ok := s.leaseOf(clientMACAddress)
 	if ok && !existingLease.IsExpired() {
-		s.log.Infof("[TXN: %s] Server '%s' requested termination of lease on IPv4 address %s.",
+		s.log.Info(withFields(Fields{"mac": clientMACAddress, "ip": existingLease.IPAddress.String()},
+			"[TXN: %s] Server '%s' requested termination of lease on IPv4 address %s.",
 			transactionID,
 			clientMACAddress,
 			existingLease.IPAddress.String(),
-		)
+		))
 
-		s.expireLease(existingLease)
+		s.expireLease(clientMACAddress)
 	} else {
-		s.log.Infof("[TXN: %s] Server '%s' requested requested termination of expired or non-existent lease; request ignored.",
+		s.log.Info(withFields(Fields{"mac": clientMACAddress},
+			"[TXN: %s] Server '%s' requested requested termination of expired or non-existent lease; request ignored.",
 			transactionID,
 			clientMACAddress,
-		)
+		))
 	}
 
 	return s.noReply() // No reply is necessary for Release.
@@ -274,26 +384,42 @@ func (s *DHCPService) addIPXEOptions(request dhcp.Packet, requestOptions dhcp.Op
 
 	if isIPXEClient(requestOptions) {
 		// This is an iPXE client; direct them to load the iPXE boot script.
-		s.log.Infof("[TXN: %s] Client with MAC address %s is an iPXE client; boot script '%s'.",
+		s.log.Info(withFields(Fields{"mac": request.CHAddr().String(), "file": s.IPXEBootScript},
+			"[TXN: %s] Client with MAC address %s is an iPXE client; boot script '%s'.",
 			transactionID,
 			request.CHAddr().String(),
 			s.IPXEBootScript,
-		)
+		))
 
 		s.addIPXEBootScript(reply)
 	} else {
-		// This is a PXE client; direct them to load the standard PXE boot image.
-		s.log.Infof("[TXN: %s] Client with MAC address %s is a regular PXE; iPXE boot image 'tftp://%s/%s'.",
+		// This is a PXE client; direct them to load the boot image of its firmware.
+		bootImage := s.pxeBootImage(requestOptions)
+		s.log.Info(withFields(Fields{"mac": request.CHAddr().String(), "file": bootImage},
+			"[TXN: %s] Client with MAC address %s is a regular PXE; boot image 'tftp://%s/%s'.",
 			transactionID,
 			request.CHAddr().String(),
 			s.ServiceIP,
-			s.PXEBootImage,
-		)
+			bootImage,
+		))
 
-		s.addPXEBootImage(reply)
+		s.addPXEBootImage(reply, bootImage)
 	}
 }
 
+// pxeBootImage returns the boot image of a PXE client: the Secure Boot
+// shim for clients of the Secure Boot class, GRUB for other x86-64 UEFI
+// clients if it is configured, and the PXE boot image for the rest.
+func (s *DHCPService) pxeBootImage(requestOptions dhcp.Options) string {
+	if isClientOfClass(requestOptions, s.SecureBootClass) {
+		return s.SecureBootFile
+	}
+	if s.GrubEFIFile != "" && isEFIX64Client(requestOptions) {
+		return s.GrubEFIFile
+	}
+	return s.PXEBootImage
+}
+
 // Add an IPXE boot script URL to a DHCP response.
 func (s *DHCPService) addIPXEBootScript(response dhcp.Packet) {
 	ipxeBootScript := s.IPXEBootScript
@@ -303,9 +429,7 @@ func (s *DHCPService) addIPXEBootScript(response dhcp.Packet) {
 }
 
 // Add a PXE boot image (and TFTP server) to a DHCP response.
-func (s *DHCPService) addPXEBootImage(response dhcp.Packet) {
-	pxeBootImage := s.PXEBootImage
-
+func (s *DHCPService) addPXEBootImage(response dhcp.Packet, pxeBootImage string) {
 	addBootFile(response, pxeBootImage)
 	addTFTPBootFile(response, s.TFTPServerName, pxeBootImage)
 }
@@ -12,14 +12,17 @@ import (
 	dhcp "github.com/krolaw/dhcp4"
 )
 
+// optionClientMachineIdentifier is the PXE client UUID option (RFC 4578).
+const optionClientMachineIdentifier dhcp.OptionCode = 97
+
 // RecordLease represents a DHCP address and lease.
 type RecordLease struct {
 	// The MAC address of the machine to which the lease belongs.
-	MACAddress string
+	MACAddress string `json:"mac_address"`
 	// The leased IPv4 address.
-	IPAddress net.IP
+	IPAddress net.IP `json:"ip_address"`
 	// The date and time when the lease expires.
-	Expires time.Time
+	Expires time.Time `json:"expires"`
 }
 
 func init() {
@@ -40,7 +43,7 @@ func (s *DHCPService) createIP(clientMACAddress string, rangeStart net.IP, range
 	rangeStartInt := binary.BigEndian.Uint32(rangeStart.To4())
 	rangeEndInt := binary.BigEndian.Uint32(rangeEnd.To4())
 	binary.BigEndian.PutUint32(ip, random(rangeStartInt, rangeEndInt))
-	taken := s.checkIfTaken(ip)
+	taken := s.checkIfTaken(ip) || s.isReservedForOther(ip, clientMACAddress)
 	for taken {
 		ipInt := binary.BigEndian.Uint32(ip)
 		ipInt++
@@ -48,7 +51,7 @@ func (s *DHCPService) createIP(clientMACAddress string, rangeStart net.IP, range
 		if ipInt > rangeEndInt {
 			break
 		}
-		taken = s.checkIfTaken(ip)
+		taken = s.checkIfTaken(ip) || s.isReservedForOther(ip, clientMACAddress)
 	}
 	for taken {
 		ipInt := binary.BigEndian.Uint32(ip)
@@ -57,14 +60,14 @@ func (s *DHCPService) createIP(clientMACAddress string, rangeStart net.IP, range
 		if ipInt < rangeStartInt {
 			return &RecordLease{}, errors.New("no new IP addresses available")
 		}
-		taken = s.checkIfTaken(ip)
+		taken = s.checkIfTaken(ip) || s.isReservedForOther(ip, clientMACAddress)
 	}
 	newLease := &RecordLease{
 		MACAddress: clientMACAddress,
 		IPAddress:  ip,
 		Expires:    time.Now(),
 	}
-	s.leasesByMACAddress[clientMACAddress] = newLease
+	s.setLease(newLease)
 
 	return newLease, nil
 }
@@ -81,41 +84,100 @@ func (s *DHCPService) checkIfTaken(ip net.IP) bool {
 	return taken
 }
 
+// check if an IP address is reserved in the inventory for another host.
+func (s *DHCPService) isReservedForOther(ip net.IP, clientMACAddress string) bool {
+	if s.inventory == nil {
+		return false
+	}
+	mac, ok := s.inventory.reservedFor(ip)
+	return ok && mac != clientMACAddress
+}
+
+// reserveIP records an offer of a reserved address to its host.
+func (s *DHCPService) reserveIP(clientMACAddress string, ip net.IP) *RecordLease {
+	s.acquireStateLock("reserveIP")
+	defer s.releaseStateLock("reserveIP")
+	newLease := &RecordLease{
+		MACAddress: clientMACAddress,
+		IPAddress:  ip,
+		Expires:    time.Now(),
+	}
+	s.setLease(newLease)
+
+	return newLease
+}
+
 func random(min uint32, max uint32) uint32 {
 	return uint32(rand.Intn(int(max-min))) + min
 }
 
 func (s *DHCPService) createLease(clientMACAddress string, ipAddress net.IP) RecordLease {
+	s.acquireStateLock("createLease")
+	defer s.releaseStateLock("createLease")
 	newLease := &RecordLease{
 		MACAddress: clientMACAddress,
 		IPAddress:  ipAddress,
 		Expires:    time.Now().Add(s.LeaseDuration),
 	}
-	s.leasesByMACAddress[clientMACAddress] = newLease
+	s.setLease(newLease)
 
 	return *newLease
 }
 
+// leaseOf returns a copy of the lease of a MAC address, expired or not.
+func (s *DHCPService) leaseOf(clientMACAddress string) (RecordLease, bool) {
+	s.acquireStateLock("leaseOf")
+	defer s.releaseStateLock("leaseOf")
+	lease, ok := s.leasesByMACAddress[clientMACAddress]
+	if !ok {
+		return RecordLease{}, false
+	}
+	return *lease, true
+}
+
 // Renew lease.
-func (s *DHCPService) renewLease(lease *RecordLease) {
+func (s *DHCPService) renewLease(clientMACAddress string) {
 	s.acquireStateLock("renewLease")
 	defer s.releaseStateLock("renewLease")
 
-	lease.Expires = time.Now().Add(s.LeaseDuration)
+	if lease, ok := s.leasesByMACAddress[clientMACAddress]; ok {
+		lease.Expires = time.Now().Add(s.LeaseDuration)
+	}
 }
 
 // Remove a lease.
-func (s *DHCPService) expireLease(lease *RecordLease) {
+func (s *DHCPService) expireLease(clientMACAddress string) {
 	s.acquireStateLock("expireLease")
 	defer s.releaseStateLock("expireLease")
 
-	lease.Expires = time.Now()
+	s.deleteLease(clientMACAddress)
+}
+
+// setLease records a lease, replacing the previous lease of its MAC
+// address; the caller holds the state lock.
+func (s *DHCPService) setLease(lease *RecordLease) {
+	s.deleteLease(lease.MACAddress)
+	s.leasesByMACAddress[lease.MACAddress] = lease
+	s.leasesByIP[lease.IPAddress.String()] = lease
+}
 
-	delete(s.leasesByMACAddress, lease.MACAddress)
+// deleteLease removes the lease of a MAC address; the caller holds the
+// state lock.
+func (s *DHCPService) deleteLease(clientMACAddress string) {
+	lease, ok := s.leasesByMACAddress[clientMACAddress]
+	if !ok {
+		return
+	}
+	delete(s.leasesByMACAddress, clientMACAddress)
+	if ip := lease.IPAddress.String(); s.leasesByIP[ip] == lease {
+		delete(s.leasesByIP, ip)
+	}
 }
 
 // Remove expired leases.
 func (s *DHCPService) pruneLeases() {
+	s.acquireStateLock("pruneLeases")
+	defer s.releaseStateLock("pruneLeases")
 	now := time.Now()
 
 	var expired []string
@@ -128,7 +190,7 @@ func (s *DHCPService) pruneLeases() {
 	}
 
 	for _, macAddress := range expired {
-		delete(s.leasesByMACAddress, macAddress)
+		s.deleteLease(macAddress)
 	}
 }
 
@@ -164,6 +226,20 @@ func getVendorClassIdentifier(requestOptions dhcp.Options) string {
 	return ""
 }
 
+// Get the client machine identifier (option 97, the SMBIOS UUID sent by
+// PXE clients) as a string, or "" if it is missing.
+func getClientUUID(requestOptions dhcp.Options) string {
+	guid, ok := requestOptions[optionClientMachineIdentifier]
+	if !ok || len(guid) != 17 || guid[0] != 0 {
+		return ""
+	}
+	b := guid[1:]
+	// The first three fields are little endian, as printed by dmidecode.
+	return fmt.Sprintf("%02x%02x%02x%02x-%02x%02x-%02x%02x-%02x%02x-%02x%02x%02x%02x%02x%02x",
+		b[3], b[2], b[1], b[0], b[5], b[4], b[7], b[6],
+		b[8], b[9], b[10], b[11], b[12], b[13], b[14], b[15])
+}
+
 // Create a reply packet.
 func newReply(request dhcp.Packet, messageType dhcp.MessageType, serverIP, clientIP net.IP,
 	leaseDuration time.Duration, options []dhcp.Option) (reply dhcp.Packet) {
@@ -222,3 +298,31 @@ func isPXEClient(requestOptions dhcp.Options) bool {
 func isIPXEClient(requestOptions dhcp.Options) bool {
 	return getUserClass(requestOptions) == "iPXE"
 }
+
+// Client system architectures of x86-64 UEFI firmware (RFC 4578, option 93).
+const (
+	clientArchEFIBC  = 7
+	clientArchEFIX64 = 9
+)
+
+// Determine if the DHCP request comes from x86-64 UEFI firmware, by the
+// client architecture option or else the "PXEClient:Arch:xxxxx" vendor class.
+func isEFIX64Client(requestOptions dhcp.Options) bool {
+	arch := -1
+	if value, ok := requestOptions[dhcp.OptionClientArchitecture]; ok && len(value) >= 2 {
+		arch = int(binary.BigEndian.Uint16(value))
+	} else if vendorClass := getVendorClassIdentifier(requestOptions); strings.HasPrefix(vendorClass, "PXEClient:Arch:") {
+		fmt.Sscanf(strings.TrimPrefix(vendorClass, "PXEClient:Arch:"), "%5d", &arch)
+	}
+	return arch == clientArchEFIBC || arch == clientArchEFIX64
+}
+
+// Determine if the DHCP request comes from a client of the class, which
+// is matched against the whole user class or the start of the vendor class.
+func isClientOfClass(requestOptions dhcp.Options, class string) bool {
+	if class == "" {
+		return false
+	}
+	return getUserClass(requestOptions) == class ||
+		strings.HasPrefix(getVendorClassIdentifier(requestOptions), class)
+}
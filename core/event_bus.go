@@ -0,0 +1,368 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// Topics published on the event bus. Sinks select topics by name or by a
+// pattern such as "install.*".
+const (
+	TopicUnknownHost  = "host.unknown"  // a MAC address not in the inventory PXE booted for the first time
+	TopicLease        = "dhcp.lease"    // a lease was granted or renewed
+	TopicTFTPDownload = "tftp.download" // a TFTP transfer completed
+	TopicTFTPFailed   = "tftp.failed"   // a TFTP transfer failed or was aborted
+	TopicHTTPDownload = "http.download" // a file was downloaded over HTTP
+	TopicHTTPFailed   = "http.failed"   // an HTTP download failed or was aborted
+	TopicHostRearmed  = "host.rearmed"  // a host was set to install again
+	// Install events are published as "install." + the event type:
+	// install.start, install.progress, install.success, install.failure.
+	topicInstallPrefix = "install."
+)
+
+// BusEvent is an event published on the event bus. It is the body of
+// webhook requests and a line of the audit file.
+type BusEvent struct {
+	ID      string                 `json:"id"`
+	Time    time.Time              `json:"time"`
+	Topic   string                 `json:"topic"`
+	MAC     string                 `json:"mac,omitempty"`
+	IP      string                 `json:"ip,omitempty"`
+	Message string                 `json:"message"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+// WebhookConfig configures an HTTP webhook sink.
+type WebhookConfig struct {
+	URL     string   `mapstructure:"url"`
+	Secret  string   `mapstructure:"secret"`  // HMAC-SHA256 key of the X-Pxesrv-Signature header
+	Topics  []string `mapstructure:"topics"`  // topics or patterns sent, empty sends all
+	Timeout int      `mapstructure:"timeout"` // seconds per attempt
+	Retries int      `mapstructure:"retries"` // attempts after the first one
+	Backoff int      `mapstructure:"backoff"` // seconds before the first retry, doubled on each retry
+}
+
+// validate checks the webhook configuration.
+func (c WebhookConfig) validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("notify.webhooks: %q is not an http or https URL", c.URL)
+	}
+	if c.Timeout < 0 || c.Retries < 0 || c.Backoff < 0 {
+		return fmt.Errorf("notify.webhooks: %s: timeout, retries and backoff cannot be negative", c.URL)
+	}
+	return validTopics(c.Topics)
+}
+
+// validTopics checks the topic patterns of a sink.
+func validTopics(topics []string) error {
+	for _, topic := range topics {
+		if _, err := path.Match(topic, ""); err != nil {
+			return fmt.Errorf("notify: invalid topic pattern %q", topic)
+		}
+	}
+	return nil
+}
+
+// eventSink delivers events. Send may block, for example while retrying;
+// it gives up when stop is closed.
+type eventSink interface {
+	Name() string
+	Send(e BusEvent, stop <-chan struct{}) error
+}
+
+// subscription is a sink with its topics and queue. Each subscription is
+// served by its own goroutine, so a slow webhook does not hold up the
+// others, and events reach a sink in the order they were published.
+type subscription struct {
+	sink   eventSink
+	topics []string
+	queue  chan BusEvent
+}
+
+func (sub *subscription) wants(topic string) bool {
+	if len(sub.topics) == 0 {
+		return true
+	}
+	for _, pattern := range sub.topics {
+		if ok, _ := path.Match(pattern, topic); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// eventBus fans out published events to the sinks. Publish never blocks:
+// events for a sink whose queue is full are dropped and logged.
+type eventBus struct {
+	lock    sync.RWMutex
+	subs    []*subscription
+	closed  bool
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	log     *logging.Logger
+	metrics *metrics
+}
+
+func newEventBus(log *logging.Logger, m *metrics) *eventBus {
+	return &eventBus{stop: make(chan struct{}), log: log, metrics: m}
+}
+
+// subscribe starts delivering the events matching topics to sink.
+func (b *eventBus) subscribe(sink eventSink, topics []string, queueSize int) {
+	sub := &subscription{sink: sink, topics: topics, queue: make(chan BusEvent, queueSize)}
+	b.lock.Lock()
+	b.subs = append(b.subs, sub)
+	b.lock.Unlock()
+	b.wg.Add(1)
+	go b.deliver(sub)
+}
+
+func (b *eventBus) deliver(sub *subscription) {
+	defer b.wg.Done()
+	for e := range sub.queue {
+		if err := sub.sink.Send(e, b.stop); err != nil {
+			b.log.Warningf("[PXES] event %s (%s) not delivered to %s: %s", e.ID, e.Topic, sub.sink.Name(), err)
+			b.metrics.eventDeliveries.Inc(sub.sink.Name(), "failed")
+			continue
+		}
+		b.metrics.eventDeliveries.Inc(sub.sink.Name(), "delivered")
+	}
+}
+
+// Publish stamps e with an ID and time and queues it for every sink
+// subscribed to its topic. A nil bus discards events.
+func (b *eventBus) Publish(e BusEvent) {
+	if b == nil {
+		return
+	}
+	e.ID = newEventID()
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.metrics.eventsPublished.Inc(e.Topic)
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if b.closed {
+		return
+	}
+	for _, sub := range b.subs {
+		if !sub.wants(e.Topic) {
+			continue
+		}
+		select {
+		case sub.queue <- e:
+		default:
+			b.log.Warningf("[PXES] event queue of %s is full, dropped event %s (%s)", sub.sink.Name(), e.ID, e.Topic)
+			b.metrics.eventDeliveries.Inc(sub.sink.Name(), "dropped")
+		}
+	}
+}
+
+// Close stops accepting events and waits until the queued ones are
+// delivered or ctx is done, then abandons the retries in progress.
+func (b *eventBus) Close(ctx context.Context) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return
+	}
+	b.closed = true
+	for _, sub := range b.subs {
+		close(sub.queue)
+	}
+	b.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		b.log.Warning("[PXES] events still queued at shutdown deadline were not delivered")
+	}
+	close(b.stop)
+}
+
+func newEventID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// auditSink appends every event as a JSON line to a file.
+type auditSink struct {
+	fileName string
+	file     *os.File
+}
+
+func newAuditSink(fileName string) (*auditSink, error) {
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &auditSink{fileName: fileName, file: file}, nil
+}
+
+func (a *auditSink) Name() string {
+	return "audit"
+}
+
+func (a *auditSink) Send(e BusEvent, stop <-chan struct{}) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = a.file.Write(append(line, '\n'))
+	return err
+}
+
+// maxWebhookBackoff caps the delay between two attempts of a webhook.
+const maxWebhookBackoff = 5 * time.Minute
+
+// webhookSink posts events as JSON to a URL. Network errors, 408, 429 and
+// 5xx answers are retried with exponential backoff; other answers are
+// final.
+type webhookSink struct {
+	name    string
+	url     string
+	secret  []byte
+	retries int
+	backoff time.Duration
+	client  *http.Client
+}
+
+func newWebhookSink(c WebhookConfig) *webhookSink {
+	u, _ := url.Parse(c.URL)
+	return &webhookSink{
+		name:    "webhook:" + u.Host,
+		url:     c.URL,
+		secret:  []byte(c.Secret),
+		retries: c.Retries,
+		backoff: time.Duration(c.Backoff) * time.Second,
+		client:  &http.Client{Timeout: time.Duration(c.Timeout) * time.Second},
+	}
+}
+
+func (h *webhookSink) Name() string {
+	return h.name
+}
+
+func (h *webhookSink) Send(e BusEvent, stop <-chan struct{}) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	delay := h.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := h.post(e, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt > h.retries {
+			return fmt.Errorf("attempt %d: %s", attempt, err)
+		}
+		select {
+		case <-time.After(delay):
+		case <-stop:
+			return fmt.Errorf("attempt %d: %s, shutting down", attempt, err)
+		}
+		if delay *= 2; delay > maxWebhookBackoff {
+			delay = maxWebhookBackoff
+		}
+	}
+}
+
+// post makes one attempt and reports whether a failure may be retried.
+// The body is signed with HMAC-SHA256 when a secret is set; receivers
+// check X-Pxesrv-Signature against "sha256=" + hex(hmac(secret, body)).
+func (h *webhookSink) post(e BusEvent, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "pxesrv")
+	req.Header.Set("X-Pxesrv-Event", e.Topic)
+	req.Header.Set("X-Pxesrv-Delivery", e.ID)
+	if len(h.secret) > 0 {
+		mac := hmac.New(sha256.New, h.secret)
+		mac.Write(body)
+		req.Header.Set("X-Pxesrv-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= 500:
+		return true, fmt.Errorf("%s answered %s", h.url, resp.Status)
+	default:
+		return false, fmt.Errorf("%s answered %s", h.url, resp.Status)
+	}
+}
+
+// startEventBus creates the event bus with the configured sinks.
+func (s *Service) startEventBus() error {
+	s.bus = newEventBus(s.Logger, s.metrics)
+	if s.AuditFile != "" {
+		audit, err := newAuditSink(s.AuditFile)
+		if err != nil {
+			return err
+		}
+		s.bus.subscribe(audit, nil, s.EventQueueSize)
+		s.Logger.Infof("[PXES] writing audit events to %s", s.AuditFile)
+	}
+	for _, c := range s.Webhooks {
+		hook := newWebhookSink(c)
+		s.bus.subscribe(hook, c.Topics, s.EventQueueSize)
+		s.Logger.Infof("[PXES] sending events to webhook %s", c.URL)
+	}
+	return nil
+}
+
+// clientMAC returns the MAC address leased the client address addr, as
+// found in a TFTP or HTTP remote address, or "" if it has no lease.
+func (s *Service) clientMAC(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || s.dhcpService == nil {
+		return ""
+	}
+	lease, _ := s.dhcpService.LeaseByIP(ip)
+	return lease.MACAddress
+}
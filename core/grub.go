@@ -0,0 +1,42 @@
+package core
+
+import (
+	"fmt"
+	"net/url"
+	"text/template"
+)
+
+// grubHostConfigPrefix starts the name of the per-host configs GRUB looks
+// for in the directory of its EFI binary before grub.cfg:
+// grub.cfg-01-aa-bb-cc-dd-ee-ff.
+const grubHostConfigPrefix = "grub.cfg-01-"
+
+// grubLocalBoot returns to the firmware, which continues with its next
+// boot entry, normally the local disk.
+var grubLocalBoot = []byte("set default=0\nset timeout=0\nmenuentry 'Boot from local disk' {\n  exit\n}\n")
+
+var grubTemplate = template.Must(template.New("grub.cfg").Funcs(templateFuncs("")).Parse(`set default=0
+set timeout=0
+menuentry '{{.Profile.Name}} on {{.Host.MAC}}' {
+  linux {{grubPath .Kernel}} {{.Cmdline | replace ";" "\\;" | replace "&" "\\&"}}
+{{- if .Initrd}}
+  initrd {{grubPath .Initrd}}
+{{- end}}
+}
+`))
+
+// grubPath turns an http or tftp URL into a GRUB file name:
+// http://192.168.1.61/centos/7/isolinux/vmlinuz becomes
+// (http,192.168.1.61)/centos/7/isolinux/vmlinuz. GRUB before 2.06 cannot
+// take a port, so boot files are best served on port 80.
+func grubPath(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "tftp") || u.Host == "" {
+		return "", fmt.Errorf("grubPath: %q is not an http or tftp URL", rawURL)
+	}
+	host := u.Host
+	if u.Scheme == "http" && u.Port() == "80" {
+		host = u.Hostname()
+	}
+	return fmt.Sprintf("(%s,%s)%s", u.Scheme, host, u.EscapedPath()), nil
+}
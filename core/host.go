@@ -0,0 +1,265 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Profile describes how to boot and install an operating system.
+type Profile struct {
+	Name      string `mapstructure:"-" json:"name"`
+	Kernel    string `mapstructure:"kernel" json:"kernel"`       // kernel path below the HTTP root, or a full URL
+	Initrd    string `mapstructure:"initrd" json:"initrd"`       // initrd path below the HTTP root, or a full URL
+	Cmdline   string `mapstructure:"cmdline" json:"cmdline"`     // kernel command line, may use template fields
+	Kickstart string `mapstructure:"kickstart" json:"kickstart"` // kickstart/preseed path below the HTTP root
+	Ignition  string `mapstructure:"ignition" json:"ignition"`   // Butane template below templates/ignition, adds ignition.config.url
+	Windows   string `mapstructure:"windows" json:"windows"`     // extracted Windows media below the HTTP root, booted by the wimboot kernel
+}
+
+// Host is a machine known to pxesrv. It is identified by its MAC address,
+// SMBIOS UUID or serial number; the MAC address may be left out if one of
+// the others is set.
+type Host struct {
+	MAC      string            `mapstructure:"mac" yaml:"mac" json:"mac"`
+	UUID     string            `mapstructure:"uuid" yaml:"uuid,omitempty" json:"uuid,omitempty"`
+	Serial   string            `mapstructure:"serial" yaml:"serial,omitempty" json:"serial,omitempty"`
+	Hostname string            `mapstructure:"hostname" yaml:"hostname,omitempty" json:"hostname,omitempty"`
+	IP       string            `mapstructure:"ip" yaml:"ip,omitempty" json:"ip,omitempty"` // reserved DHCP address
+	Profile  string            `mapstructure:"profile" yaml:"profile,omitempty" json:"profile,omitempty"`
+	Metadata map[string]string `mapstructure:"metadata" yaml:"metadata,omitempty" json:"metadata,omitempty"`
+	source   string            // file the host was read from, empty for the config file
+}
+
+// inventory holds the known hosts and the profiles assigned to them.
+type inventory struct {
+	lock     sync.RWMutex
+	profiles map[string]Profile
+	hosts    map[string]*Host // by key
+	byUUID   map[string]*Host
+	bySerial map[string]*Host
+	byIP     map[string]*Host
+}
+
+func newInventory() *inventory {
+	return &inventory{
+		profiles: make(map[string]Profile),
+		hosts:    make(map[string]*Host),
+		byUUID:   make(map[string]*Host),
+		bySerial: make(map[string]*Host),
+		byIP:     make(map[string]*Host),
+	}
+}
+
+// load replaces the inventory content after checking that every host has
+// a valid MAC address, or a UUID or serial number instead, unique
+// identifiers and refers to a known profile.
+func (inv *inventory) load(profiles map[string]Profile, hosts []Host) error {
+	byName := make(map[string]Profile, len(profiles))
+	for name, profile := range profiles {
+		if profile.Kernel == "" {
+			return fmt.Errorf("profile %s: kernel is required", name)
+		}
+		profile.Name = name
+		byName[name] = profile
+	}
+	next := newInventory()
+	next.profiles = byName
+	for i := range hosts {
+		host := hosts[i]
+		host.UUID = strings.ToLower(host.UUID)
+		if host.MAC != "" || (host.UUID == "" && host.Serial == "") {
+			mac, err := normalizeMAC(host.MAC)
+			if err != nil {
+				return fmt.Errorf("host %q: %s", host.MAC, err)
+			}
+			host.MAC = mac
+		}
+		if _, ok := byName[host.Profile]; host.Profile != "" && !ok {
+			return fmt.Errorf("host %s: unknown profile %q", host.key(), host.Profile)
+		}
+		if host.IP != "" && net.ParseIP(host.IP).To4() == nil {
+			return fmt.Errorf("host %s: %q is not an IPv4 address", host.key(), host.IP)
+		}
+		if err := next.add(&host); err != nil {
+			return err
+		}
+	}
+
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+	inv.profiles = next.profiles
+	inv.hosts = next.hosts
+	inv.byUUID = next.byUUID
+	inv.bySerial = next.bySerial
+	inv.byIP = next.byIP
+	return nil
+}
+
+func (inv *inventory) add(host *Host) error {
+	key := host.key()
+	if _, ok := inv.hosts[key]; ok {
+		return fmt.Errorf("host %s: duplicate entry", key)
+	}
+	inv.hosts[key] = host
+	indexes := []struct {
+		name  string
+		key   string
+		index map[string]*Host
+	}{
+		{"uuid", host.UUID, inv.byUUID},
+		{"serial", host.Serial, inv.bySerial},
+		{"ip", host.IP, inv.byIP},
+	}
+	for _, i := range indexes {
+		if i.key == "" {
+			continue
+		}
+		if other, ok := i.index[i.key]; ok {
+			return fmt.Errorf("host %s: %s %s already used by %s", key, i.name, i.key, other.key())
+		}
+		i.index[i.key] = host
+	}
+	return nil
+}
+
+// key identifies the host in the inventory: its MAC address, or its UUID
+// or serial number if it has none.
+func (h *Host) key() string {
+	switch {
+	case h.MAC != "":
+		return h.MAC
+	case h.UUID != "":
+		return "uuid:" + h.UUID
+	default:
+		return "serial:" + h.Serial
+	}
+}
+
+// find returns the host matching the MAC address, UUID or serial number,
+// in that order, together with its profile. A host without a MAC address
+// in the inventory is given mac, so its state follows the MAC address it
+// boots with.
+func (inv *inventory) find(mac, uuid, serial string) (*Host, *Profile, bool) {
+	inv.lock.RLock()
+	defer inv.lock.RUnlock()
+	var host *Host
+	mac, err := normalizeMAC(mac)
+	if err == nil {
+		host = inv.hosts[mac]
+	}
+	if host == nil && uuid != "" {
+		host = inv.byUUID[strings.ToLower(uuid)]
+	}
+	if host == nil && serial != "" {
+		host = inv.bySerial[serial]
+	}
+	if host == nil {
+		return nil, nil, false
+	}
+	h := *host
+	if h.MAC == "" && err == nil {
+		h.MAC = mac
+	}
+	profile, ok := inv.profiles[host.Profile]
+	if !ok {
+		return &h, nil, true
+	}
+	return &h, &profile, true
+}
+
+// lookup returns the host with the given MAC address and its profile.
+func (inv *inventory) lookup(mac string) (*Host, *Profile, bool) {
+	return inv.find(mac, "", "")
+}
+
+// reservedFor returns the MAC address of the host the IP address is
+// reserved for, empty for a host known by its UUID or serial number.
+func (inv *inventory) reservedFor(ip net.IP) (string, bool) {
+	inv.lock.RLock()
+	defer inv.lock.RUnlock()
+	host, ok := inv.byIP[ip.String()]
+	if !ok {
+		return "", false
+	}
+	return host.MAC, true
+}
+
+// Hosts returns a copy of all hosts, sorted by key.
+func (inv *inventory) Hosts() []Host {
+	inv.lock.RLock()
+	defer inv.lock.RUnlock()
+	hosts := make([]Host, 0, len(inv.hosts))
+	for _, host := range inv.hosts {
+		hosts = append(hosts, *host)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].key() < hosts[j].key() })
+	return hosts
+}
+
+// Profiles returns a copy of all profiles by name.
+func (inv *inventory) Profiles() map[string]Profile {
+	inv.lock.RLock()
+	defer inv.lock.RUnlock()
+	profiles := make(map[string]Profile, len(inv.profiles))
+	for name, profile := range inv.profiles {
+		profiles[name] = profile
+	}
+	return profiles
+}
+
+// loadHostDir reads every .yml/.yaml file in dir. A file holds a single
+// host or a list of hosts. A missing directory holds no hosts.
+func loadHostDir(dir string) ([]Host, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var hosts []Host
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+		if file.IsDir() || (ext != ".yml" && ext != ".yaml") {
+			continue
+		}
+		name := filepath.Join(dir, file.Name())
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var list []Host
+		if err := yaml.UnmarshalStrict(data, &list); err != nil {
+			var host Host
+			if err := yaml.UnmarshalStrict(data, &host); err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+			list = []Host{host}
+		}
+		for i := range list {
+			list[i].source = name
+		}
+		hosts = append(hosts, list...)
+	}
+	return hosts, nil
+}
+
+// normalizeMAC returns mac in lower case colon separated form.
+func normalizeMAC(mac string) (string, error) {
+	hw, err := net.ParseMAC(strings.TrimSpace(mac))
+	if err != nil {
+		return "", err
+	}
+	return hw.String(), nil
+}
@@ -0,0 +1,317 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// hostView is a host as returned by the API, with its provisioning state,
+// latest install event and DHCP lease.
+type hostView struct {
+	Host
+	Source    string        `json:"source"` // file the host is defined in
+	Status    HostStatus    `json:"status"`
+	LastEvent *InstallEvent `json:"last_event,omitempty"`
+	Lease     *RecordLease  `json:"lease,omitempty"`
+}
+
+func (s *Service) newHostView(host Host) hostView {
+	view := hostView{Host: host, Source: host.source, Status: s.provision.Get(host.MAC)}
+	if view.Source == "" {
+		view.Source = s.ConfigFile
+	}
+	if event, ok := s.installEvents.Last(host.MAC); ok {
+		event.Log = ""
+		view.LastEvent = &event
+	}
+	if s.dhcpService != nil {
+		if lease, ok := s.dhcpService.Lease(host.MAC); ok {
+			view.Lease = &lease
+		}
+	}
+	return view
+}
+
+// serveHostAPI handles /api/v1/hosts, /api/v1/hosts/{mac} and
+// /api/v1/hosts/{mac}/{action}.
+func (s *Service) serveHostAPI(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 0 {
+		if !allowMethods(w, r, parts, http.MethodGet, http.MethodPost) {
+			return
+		}
+		if r.Method == http.MethodGet {
+			views := []hostView{}
+			for _, host := range s.inventory.Hosts() {
+				views = append(views, s.newHostView(host))
+			}
+			writeJSON(w, http.StatusOK, views)
+			return
+		}
+		var host Host
+		if err := json.NewDecoder(r.Body).Decode(&host); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid host: %s", err))
+			return
+		}
+		s.writeHostResult(w, host.MAC, http.StatusCreated)(s.putHost(host, true))
+		return
+	}
+
+	mac, err := normalizeMAC(parts[0])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(parts) == 1 {
+		if !allowMethods(w, r, nil, http.MethodGet, http.MethodPut, http.MethodDelete) {
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			host, _, ok := s.inventory.lookup(mac)
+			if !ok {
+				writeError(w, http.StatusNotFound, fmt.Sprintf("unknown host %s", mac))
+				return
+			}
+			writeJSON(w, http.StatusOK, s.newHostView(*host))
+		case http.MethodPut:
+			var host Host
+			if err := json.NewDecoder(r.Body).Decode(&host); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid host: %s", err))
+				return
+			}
+			host.MAC = mac
+			s.writeHostResult(w, mac, http.StatusOK)(s.putHost(host, false))
+		case http.MethodDelete:
+			code, err := s.deleteHost(mac)
+			if err != nil {
+				writeError(w, code, err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+	if len(parts) > 2 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	action := parts[1]
+	if (action == "installed" || action == "events") && r.Method == http.MethodPost && !s.knownHost(mac) {
+		s.Logger.Warningf("[HTTP] %s callback for unknown host %s from %s rejected", action, mac, r.RemoteAddr)
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown host %s", mac))
+		return
+	}
+	if (action == "installed" || action == "events") && r.Method == http.MethodPost && !s.fromHost(r, mac) {
+		s.Logger.Warningf("[HTTP] %s callback for %s from %s rejected: not its address and no install token", action, mac, r.RemoteAddr)
+		writeError(w, http.StatusForbidden, fmt.Sprintf("callbacks of %s are accepted from its address or with its install token", mac))
+		return
+	}
+	switch {
+	case action == "state" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, s.provision.Get(mac))
+	case action == "installed" && r.Method == http.MethodPost:
+		status, err := s.provision.Advance(mac, StateInstalled)
+		if err != nil {
+			s.Logger.Warningf("[HTTP] install completion from %s rejected: %s", mac, err)
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		s.Logger.Infof("[HTTP] host %s finished installing (install #%d), next boot is from local disk", mac, status.Installs)
+		s.bus.Publish(BusEvent{
+			Topic:   topicInstallPrefix + EventSuccess,
+			MAC:     mac,
+			Message: fmt.Sprintf("host %s finished installing", mac),
+			Data:    map[string]interface{}{"state": status.State, "installs": status.Installs},
+		})
+		writeJSON(w, http.StatusOK, status)
+	case action == "rearm" && r.Method == http.MethodPost:
+		status, err := s.provision.Rearm(mac)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		s.Logger.Infof("[HTTP] host %s re-armed for reinstall", mac)
+		s.bus.Publish(BusEvent{
+			Topic:   TopicHostRearmed,
+			MAC:     mac,
+			Message: fmt.Sprintf("host %s will install again on its next boot", mac),
+		})
+		writeJSON(w, http.StatusOK, status)
+	case action == "events" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, s.installEvents.Get(mac))
+	case action == "events" && r.Method == http.MethodPost:
+		s.serveInstallEvent(w, r, mac)
+	case action == "reservation" && (r.Method == http.MethodPut || r.Method == http.MethodDelete):
+		host, _, ok := s.inventory.lookup(mac)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("unknown host %s", mac))
+			return
+		}
+		host.IP = ""
+		if r.Method == http.MethodPut {
+			var reservation struct {
+				IP string `json:"ip"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&reservation); err != nil || reservation.IP == "" {
+				writeError(w, http.StatusBadRequest, `expected {"ip": "<address>"}`)
+				return
+			}
+			host.IP = reservation.IP
+		}
+		s.writeHostResult(w, mac, http.StatusOK)(s.putHost(*host, false))
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// serveReservationAPI handles /api/v1/reservations, the hosts with a
+// reserved address.
+func (s *Service) serveReservationAPI(w http.ResponseWriter, r *http.Request, parts []string) {
+	if !allowMethods(w, r, parts, http.MethodGet) {
+		return
+	}
+	reservations := []Host{}
+	for _, host := range s.inventory.Hosts() {
+		if host.IP != "" {
+			reservations = append(reservations, host)
+		}
+	}
+	writeJSON(w, http.StatusOK, reservations)
+}
+
+// writeHostResult returns a function answering with the host, or with
+// the error of a host change.
+func (s *Service) writeHostResult(w http.ResponseWriter, mac string, success int) func(int, error) {
+	return func(code int, err error) {
+		if err != nil {
+			writeError(w, code, err.Error())
+			return
+		}
+		mac, _ = normalizeMAC(mac)
+		host, _, ok := s.inventory.lookup(mac)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("unknown host %s", mac))
+			return
+		}
+		writeJSON(w, success, s.newHostView(*host))
+	}
+}
+
+// putHost adds a host, or replaces an existing one, in its own file in the
+// inventory directory and reloads the configuration. It returns the HTTP
+// status code to answer with if it fails.
+func (s *Service) putHost(host Host, create bool) (int, error) {
+	cfg := s.settings()
+	s.hostLock.Lock()
+	defer s.hostLock.Unlock()
+	mac, err := normalizeMAC(host.MAC)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("host %q: %s", host.MAC, err)
+	}
+	host.MAC = mac
+	hosts := s.inventory.Hosts()
+	index := findHost(hosts, mac)
+	fileName := s.hostFileName(mac)
+	switch {
+	case create && index >= 0:
+		return http.StatusConflict, fmt.Errorf("host %s already exists", mac)
+	case !create && index < 0:
+		return http.StatusNotFound, fmt.Errorf("unknown host %s", mac)
+	case index >= 0:
+		if fileName, err = s.editableHostFile(hosts, index); err != nil {
+			return http.StatusConflict, err
+		}
+		hosts[index] = host
+	default:
+		if cfg.InventoryDir == "" {
+			return http.StatusConflict, fmt.Errorf("inventory.dir is not set, add hosts to %s", s.ConfigFile)
+		}
+		hosts = append(hosts, host)
+	}
+	if err := newInventory().load(cfg.Profiles, hosts); err != nil {
+		return http.StatusBadRequest, err
+	}
+	data, err := yaml.Marshal(host)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return s.replaceHostFile(fileName, data)
+}
+
+// deleteHost removes the file of a host added through the API.
+func (s *Service) deleteHost(mac string) (int, error) {
+	s.hostLock.Lock()
+	defer s.hostLock.Unlock()
+	hosts := s.inventory.Hosts()
+	index := findHost(hosts, mac)
+	if index < 0 {
+		return http.StatusNotFound, fmt.Errorf("unknown host %s", mac)
+	}
+	fileName, err := s.editableHostFile(hosts, index)
+	if err != nil {
+		return http.StatusConflict, err
+	}
+	return s.replaceHostFile(fileName, nil)
+}
+
+// replaceHostFile writes data to fileName, or removes it if data is nil,
+// and reloads the configuration. The file is restored if the reload fails.
+func (s *Service) replaceHostFile(fileName string, data []byte) (int, error) {
+	previous, readErr := ioutil.ReadFile(fileName)
+	var err error
+	if data == nil {
+		err = os.Remove(fileName)
+	} else {
+		err = writeFileAtomic(fileName, data, 0644)
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := s.Reload(); err != nil {
+		if readErr == nil {
+			writeFileAtomic(fileName, previous, 0644)
+		} else {
+			os.Remove(fileName)
+		}
+		return http.StatusInternalServerError, fmt.Errorf("reload failed, change reverted: %s", err)
+	}
+	return http.StatusOK, nil
+}
+
+// editableHostFile returns the file of hosts[index] if the API may change
+// it: hosts in the config file or sharing a file with other hosts are
+// left to be edited by hand.
+func (s *Service) editableHostFile(hosts []Host, index int) (string, error) {
+	host := hosts[index]
+	if host.source == "" {
+		return "", fmt.Errorf("host %s is defined in %s, edit it there", host.MAC, s.ConfigFile)
+	}
+	for i, other := range hosts {
+		if i != index && other.source == host.source {
+			return "", fmt.Errorf("host %s shares %s with other hosts, edit it there", host.MAC, host.source)
+		}
+	}
+	return host.source, nil
+}
+
+// hostFileName returns the inventory file of a host added through the API.
+func (s *Service) hostFileName(mac string) string {
+	return filepath.Join(s.settings().InventoryDir, strings.Replace(mac, ":", "-", -1)+".yml")
+}
+
+func findHost(hosts []Host, mac string) int {
+	for i := range hosts {
+		if hosts[i].MAC == mac {
+			return i
+		}
+	}
+	return -1
+}
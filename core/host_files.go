@@ -0,0 +1,111 @@
+package core
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// parseHostFilePath splits a request path below prefix into the MAC
+// address, token and name of one of files: prefix[<mac>/[<token>/]]<file>.
+// mac and token may be empty.
+func parseHostFilePath(prefix, p string, files []string) (mac, token, file string, ok bool) {
+	var elems []string
+	for _, elem := range strings.Split(strings.TrimPrefix(path.Clean(p), strings.TrimSuffix(prefix, "/")), "/") {
+		if elem != "" {
+			elems = append(elems, elem)
+		}
+	}
+	if len(elems) == 0 || len(elems) > 3 || !stringInSlice(elems[len(elems)-1], files) {
+		return "", "", "", false
+	}
+	file = elems[len(elems)-1]
+	if len(elems) > 1 {
+		if mac, _ = normalizeMAC(elems[0]); mac == "" {
+			return "", "", "", false
+		}
+	}
+	if len(elems) > 2 {
+		token = elems[1]
+	}
+	return mac, token, file, true
+}
+
+// hostFileURL returns the URL of the files below prefix of a host, ending
+// in a slash as the file names are appended to it. With secrets.tokens and
+// token set, a token of the host follows the MAC address. An empty mac
+// gives the URL clients are found by their address on.
+func (s *Service) hostFileURL(nextServer, prefix, mac string, token bool) (string, error) {
+	base := nextServer + prefix
+	if mac == "" {
+		return base, nil
+	}
+	cfg := s.settings()
+	base += mac + "/"
+	if cfg.SecretTokens && token {
+		token, err := s.installTokens.issue(mac, cfg.InstallWindow)
+		if err != nil {
+			return "", err
+		}
+		base += token + "/"
+	}
+	return base, nil
+}
+
+// hostFileHandler serves the files below prefix, rendered for the host
+// requesting them from the templates in dir: dir/<profile>/<file>.tmpl
+// overrides dir/<file>.tmpl for the hosts of a profile. kind names the
+// files in the log.
+func (s *Service) hostFileHandler(kind, prefix, dir string, files []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		mac, token, name, ok := parseHostFilePath(prefix, r.URL.Path, files)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		query := url.Values{}
+		if mac != "" {
+			query.Set("mac", mac)
+		}
+		if token != "" {
+			query.Set("token", token)
+		}
+		data := s.newRequestTemplateData(r.RemoteAddr, query)
+		templates := []string{path.Join(dir, name+".tmpl")}
+		if data.Profile.Name != "" {
+			templates = append([]string{path.Join(dir, data.Profile.Name, name+".tmpl")}, templates...)
+		}
+		for _, file := range templates {
+			out, ok, err := s.renderTemplateFor(file, data)
+			if !ok {
+				continue
+			}
+			if _, denied := err.(*secretDeniedError); denied {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			client := data.ClientIP
+			if data.MAC != "" {
+				client = data.MAC
+			}
+			s.Logger.Info(withFields(Fields{"mac": data.MAC, "client": data.ClientIP},
+				"[HTTP] %s %s for %s from %s/%s", kind, name, client, templatePath, file))
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-store")
+			http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(out))
+			return
+		}
+		http.NotFound(w, r)
+	}
+}
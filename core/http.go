@@ -1,6 +1,7 @@
 package core
 
 import (
+	"fmt"
 	"net"
 	"net/http"
 	"path/filepath"
@@ -9,23 +10,77 @@ import (
 	"github.com/mash/go-accesslog"
 )
 
-func (s *Service) serveHTTP(l net.Listener) error {
+// newHTTPServer creates the HTTP server serving the boot files.
+func (s *Service) newHTTPServer() *http.Server {
 	listen := net.JoinHostPort(s.ListenIP, s.HTTPPort)
 	rootPath := filepath.Join(s.DocRoot, s.HTTPRoot)
 
 	accessLogger := logger{Logger: s.Logger}
-	http.Handle("/", accesslog.NewLoggingHandler(http.FileServer(http.Dir(rootPath)), accessLogger))
+	var fileSystem http.FileSystem = http.Dir(rootPath)
+	if s.cache != nil {
+		fileSystem = cachedFileSystem{root: rootPath, cache: s.cache}
+	}
+	if len(s.isoMounts) > 0 {
+		fileSystem = isoFileSystem{mounts: s.isoMounts, base: fileSystem}
+	}
+	s.httpFileSystem = fileSystem
+	mux := http.NewServeMux()
+	mux.Handle("/", s.httpTransfers.handler(s.templateHandler(s.hostBootConfigHandler(fileSystem, http.FileServer(fileSystem))), s.publishHTTPTransfer))
+	mux.HandleFunc(bootScriptPath, s.serveBootScript)
+	mux.Handle(cloudInitPath, s.httpTransfers.handler(s.hostFileHandler("cloud-init", cloudInitPath, cloudInitTemplateDir, cloudInitFiles), s.publishHTTPTransfer))
+	mux.Handle(unattendPath, s.httpTransfers.handler(s.hostFileHandler("unattend", unattendPath, windowsTemplateDir, unattendFiles), s.publishHTTPTransfer))
+	mux.Handle(ignitionPath, s.httpTransfers.handler(http.HandlerFunc(s.serveIgnition), s.publishHTTPTransfer))
+	mux.Handle(apiPrefix, s.newAPIHandler())
+	mux.HandleFunc(dashboardPath, s.serveDashboard)
+	mux.HandleFunc(metricsPath, s.serveMetrics)
+	if s.APIToken == "" {
+		s.Logger.Warningf("[HTTP] api.token is not set, the API at %s is read-only and open to everyone", apiPrefix)
+	}
 	s.Logger.Infof("[HTTP] starting http server %s(TCP) and handle on path: %s", listen, rootPath)
 
 	httpServer := &http.Server{
-		Addr:           s.HTTPRoot,      // 监听的地址和端口
-		Handler:        nil,             // 所有请求需要调用的Handler（实际上这里说是ServeMux更确切）如果为空则设置为DefaultServeMux
-		ReadTimeout:    0 * time.Second, // 读的最大Timeout时间
-		WriteTimeout:   0 * time.Second, // 写的最大Timeout时间
-		MaxHeaderBytes: 256,             // 请求头的最大长度
-		TLSConfig:      nil,             // 配置TLS
+		Addr:           s.HTTPRoot,                                                        // 监听的地址和端口
+		Handler:        accesslog.NewLoggingHandler(s.metrics.handler(mux), accessLogger), // 所有请求需要调用的Handler
+		ReadTimeout:    0 * time.Second,                                                   // 读的最大Timeout时间
+		WriteTimeout:   0 * time.Second,                                                   // 写的最大Timeout时间
+		MaxHeaderBytes: 256,                                                               // 请求头的最大长度
+		TLSConfig:      nil,                                                               // 配置TLS
 	}
-	if err := httpServer.Serve(l); err != nil {
+	return httpServer
+}
+
+// publishHTTPTransfer publishes a finished download on the event bus.
+func (s *Service) publishHTTPTransfer(t HTTPTransfer) {
+	e := BusEvent{
+		Topic:   TopicHTTPDownload,
+		MAC:     s.clientMAC(t.Client),
+		IP:      t.Client,
+		Message: fmt.Sprintf("%s downloaded %s over HTTP", t.Client, t.Path),
+		Data: map[string]interface{}{
+			"transfer": t.ID,
+			"path":     t.Path,
+			"status":   t.Status,
+			"bytes":    t.Bytes,
+			"size":     t.Size,
+			"duration": t.End.Sub(t.Start).Round(time.Millisecond).String(),
+			"outcome":  t.Outcome,
+		},
+	}
+	if t.Outcome != TransferComplete {
+		e.Topic = TopicHTTPFailed
+		e.Message = fmt.Sprintf("HTTP download of %s by %s %s with status %d", t.Path, t.Client, t.Outcome, t.Status)
+		if t.Error != "" {
+			e.Data["error"] = t.Error
+		}
+	}
+	s.bus.Publish(e)
+}
+
+func (s *Service) serveHTTP(l net.Listener) error {
+	if err := s.httpServer.Serve(l); err != nil {
+		if err == http.ErrServerClosed {
+			return nil
+		}
 		s.Logger.Errorf("HTTP server shut down: %s", err)
 		return err
 	}
@@ -0,0 +1,163 @@
+package core
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HTTPTransfer records a file download from the HTTP server.
+type HTTPTransfer struct {
+	ID      uint64    `json:"id"`
+	Client  string    `json:"client"`
+	Method  string    `json:"method"`
+	Path    string    `json:"path"`
+	Status  int       `json:"status"`
+	Size    int64     `json:"size"` // Content-Length, -1 if unknown
+	Bytes   int64     `json:"bytes"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Outcome string    `json:"outcome"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// httpTransferLog keeps the downloads in progress and a ring of recent
+// ones, like tftpTransferLog.
+type httpTransferLog struct {
+	lock   sync.Mutex
+	active map[uint64]*HTTPTransfer
+	recent []HTTPTransfer
+	next   int
+	full   bool
+	nextID uint64
+}
+
+func newHTTPTransferLog(size int) *httpTransferLog {
+	if size <= 0 {
+		size = 256
+	}
+	return &httpTransferLog{
+		active: make(map[uint64]*HTTPTransfer),
+		recent: make([]HTTPTransfer, size),
+	}
+}
+
+func (l *httpTransferLog) begin(r *http.Request) *HTTPTransfer {
+	client, _, _ := net.SplitHostPort(r.RemoteAddr)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.nextID++
+	t := &HTTPTransfer{
+		ID:      l.nextID,
+		Client:  client,
+		Method:  r.Method,
+		Path:    r.URL.Path,
+		Size:    -1,
+		Start:   time.Now(),
+		Outcome: TransferInProgress,
+	}
+	l.active[t.ID] = t
+	return t
+}
+
+// finish completes a transfer and moves it into the recent ring. A
+// download the client broke off is aborted, an error status failed.
+func (l *httpTransferLog) finish(t *HTTPTransfer, err error) HTTPTransfer {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	t.End = time.Now()
+	switch {
+	case err != nil:
+		t.Outcome = TransferAborted
+		t.Error = err.Error()
+	case t.Status >= http.StatusBadRequest:
+		t.Outcome = TransferFailed
+	default:
+		t.Outcome = TransferComplete
+	}
+	delete(l.active, t.ID)
+	l.recent[l.next] = *t
+	l.next = (l.next + 1) % len(l.recent)
+	if l.next == 0 {
+		l.full = true
+	}
+	return *t
+}
+
+// Recent returns the finished transfers, newest first.
+func (l *httpTransferLog) Recent() []HTTPTransfer {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	count := l.next
+	if l.full {
+		count = len(l.recent)
+	}
+	transfers := make([]HTTPTransfer, 0, count)
+	for i := 1; i <= count; i++ {
+		transfers = append(transfers, l.recent[(l.next-i+len(l.recent))%len(l.recent)])
+	}
+	return transfers
+}
+
+// Active returns the transfers in progress.
+func (l *httpTransferLog) Active() []HTTPTransfer {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	transfers := make([]HTTPTransfer, 0, len(l.active))
+	for _, t := range l.active {
+		transfers = append(transfers, *t)
+	}
+	return transfers
+}
+
+// handler records every request served by next and passes each finished
+// transfer to done.
+func (l *httpTransferLog) handler(next http.Handler, done func(HTTPTransfer)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := l.begin(r)
+		tw := &transferWriter{ResponseWriter: w, log: l, transfer: t}
+		next.ServeHTTP(tw, r)
+		if tw.status == 0 {
+			tw.WriteHeader(http.StatusOK)
+		}
+		done(l.finish(t, tw.err))
+	})
+}
+
+// transferWriter counts the bytes written to a response.
+type transferWriter struct {
+	http.ResponseWriter
+	log      *httpTransferLog
+	transfer *HTTPTransfer
+	status   int
+	err      error
+}
+
+func (w *transferWriter) WriteHeader(status int) {
+	w.status = status
+	size := int64(-1)
+	if n, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil {
+		size = n
+	}
+	w.log.lock.Lock()
+	w.transfer.Status = status
+	w.transfer.Size = size
+	w.log.lock.Unlock()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *transferWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	w.log.lock.Lock()
+	w.transfer.Bytes += int64(n)
+	w.log.lock.Unlock()
+	return n, err
+}
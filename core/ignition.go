@@ -0,0 +1,426 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ignitionPath is the HTTP path of the Ignition configs. A host booted
+// with ignition.config.url=<NextServer>/ignition?mac=<mac> gets the config
+// of its profile; without a mac the client is found by its lease or
+// reservation.
+const ignitionPath = "/ignition"
+
+// ignitionTemplateDir holds the Butane templates of the Ignition configs,
+// below the templates directory.
+const ignitionTemplateDir = "ignition"
+
+// butaneVersions maps the Butane variants and versions pxesrv translates
+// to the Ignition spec version of the result.
+var butaneVersions = map[string]map[string]string{
+	"fcos":    {"1.0.0": "3.0.0", "1.1.0": "3.1.0", "1.2.0": "3.2.0", "1.3.0": "3.2.0", "1.4.0": "3.3.0", "1.5.0": "3.4.0"},
+	"flatcar": {"1.0.0": "3.3.0", "1.1.0": "3.4.0"},
+}
+
+// butaneSections are the keys of a Butane config besides its variant and
+// version. boot_device is listed to be rejected with butaneSugar.
+var butaneSections = []string{"ignition", "storage", "systemd", "passwd", "kernel_arguments", "boot_device"}
+
+// butaneSugar are the Butane fields that stand for other Ignition settings,
+// which pxesrv does not expand, and what to write instead.
+var butaneSugar = map[string]string{
+	"boot_device":     "write out the storage.disks, raid, luks and filesystems it stands for",
+	"trees":           "list the files and directories instead",
+	"with_mount_unit": "add the mount unit to systemd.units",
+}
+
+// ignitionListKeys are the fields identifying list entries, such as files
+// by path and units by name, when configs are merged.
+var ignitionListKeys = []string{"path", "name", "device"}
+
+// serveIgnition renders the Ignition config of the host requesting it.
+func (s *Service) serveIgnition(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data := s.newRequestTemplateData(r.RemoteAddr, r.URL.Query())
+	if data.Profile.Ignition == "" {
+		http.Error(w, "no Ignition config for this client", http.StatusNotFound)
+		return
+	}
+	config, err := s.renderIgnition(data)
+	if _, denied := err.(*secretDeniedError); denied {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.Logger.Info(withFields(Fields{"mac": data.Host.MAC, "profile": data.Profile.Name},
+		"[HTTP] Ignition config for %s with profile %s", data.Host.MAC, data.Profile.Name))
+	w.Header().Set("Content-Type", "application/vnd.coreos.ignition+json")
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeContent(w, r, "config.ign", time.Time{}, bytes.NewReader(config))
+}
+
+// renderIgnition renders the Butane template of the profile of data, and
+// the base template if one is configured, translates them to Ignition and
+// merges the profile's config onto the base.
+func (s *Service) renderIgnition(data *templateData) ([]byte, error) {
+	cfg := s.settings()
+	file := path.Join(ignitionTemplateDir, data.Profile.Ignition+".tmpl")
+	files := []string{file}
+	if cfg.IgnitionBase != "" {
+		files = []string{path.Join(ignitionTemplateDir, cfg.IgnitionBase+".tmpl"), file}
+	}
+	var config map[string]interface{}
+	for _, f := range files {
+		out, ok, err := s.executeTemplateFor(f, data)
+		if !ok {
+			err = &TemplateError{File: f, Err: "no such template"}
+			s.Logger.Errorf("[TMPL] %s", err)
+			return nil, err
+		}
+		if err != nil {
+			return nil, err
+		}
+		translated, err := translateButane(out)
+		if err != nil {
+			err = &TemplateError{File: f, Err: err.Error()}
+			s.metrics.templateErrors.Inc()
+			s.Logger.Errorf("[TMPL] %s", err)
+			return nil, err
+		}
+		if config == nil {
+			config = translated
+		} else {
+			config = mergeIgnition(config, translated).(map[string]interface{})
+		}
+	}
+	if err := s.allowSecrets(file, data); err != nil {
+		return nil, err
+	}
+	return json.Marshal(config)
+}
+
+// translateButane translates a Butane config to an Ignition config as
+// Butane does: the variant and version become ignition.version, keys
+// become camelCase, inline contents become data URLs, and the result is
+// validated.
+func translateButane(data []byte) (map[string]interface{}, error) {
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	config, ok := jsonValue(raw).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("a Butane config is a map with variant and version")
+	}
+	variant, _ := config["variant"].(string)
+	version, _ := config["version"].(string)
+	versions, ok := butaneVersions[variant]
+	if !ok {
+		return nil, fmt.Errorf("variant %q is not one of fcos or flatcar", variant)
+	}
+	spec, ok := versions[version]
+	if !ok {
+		return nil, fmt.Errorf("version %q of variant %s is not supported", version, variant)
+	}
+	delete(config, "variant")
+	delete(config, "version")
+	for key := range config {
+		if !stringInSlice(key, butaneSections) {
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+	}
+	if err := translateKeys("", config); err != nil {
+		return nil, err
+	}
+	ignition, ok := config["ignition"].(map[string]interface{})
+	if !ok {
+		if _, set := config["ignition"]; set {
+			return nil, fmt.Errorf("ignition must be a map")
+		}
+		ignition = make(map[string]interface{})
+	}
+	ignition["version"] = spec
+	config["ignition"] = ignition
+	if err := translateResources("", config); err != nil {
+		return nil, err
+	}
+	if err := validateIgnition(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// jsonValue converts the maps yaml decodes to map[string]interface{}, so
+// the value can be encoded as JSON.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = jsonValue(value)
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonValue(v[i])
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// translateKeys renames the snake_case keys of Butane to the camelCase
+// ones of Ignition, ssh_authorized_keys to sshAuthorizedKeys and size_mib
+// to sizeMiB, and rejects the fields of butaneSugar and Butane's local
+// files.
+func translateKeys(at string, v interface{}) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			field := strings.TrimPrefix(at+"."+key, ".")
+			if hint, ok := butaneSugar[key]; ok {
+				return fmt.Errorf("%s is not supported, %s", field, hint)
+			}
+			if strings.HasSuffix(key, "_local") {
+				return fmt.Errorf("%s is not supported, render the contents into the template instead", field)
+			}
+			if err := translateKeys(field, v[key]); err != nil {
+				return err
+			}
+			if name := ignitionKey(key); name != key {
+				v[name] = v[key]
+				delete(v, key)
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			if err := translateKeys(fmt.Sprintf("%s[%d]", at, i), value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ignitionKey returns the Ignition name of the Butane key.
+func ignitionKey(key string) string {
+	words := strings.Split(key, "_")
+	for i := 1; i < len(words); i++ {
+		switch {
+		case words[i] == "mib":
+			words[i] = "MiB"
+		case words[i] != "":
+			words[i] = strings.ToUpper(words[i][:1]) + words[i][1:]
+		}
+	}
+	return strings.Join(words, "")
+}
+
+// translateResources replaces the inline contents of files, and of merged
+// or replaced configs, by an uncompressed data URL source, as Butane
+// writes short contents. Butane's local files are not supported, a
+// template renders them inline instead.
+func translateResources(at string, v interface{}) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if inline, ok := v["inline"]; ok {
+			text, ok := inline.(string)
+			if !ok {
+				return fmt.Errorf("%s.inline must be a string", at)
+			}
+			if _, ok := v["source"]; ok {
+				return fmt.Errorf("%s: inline and source cannot both be set", at)
+			}
+			v["source"] = dataURL(text)
+			delete(v, "inline")
+			if _, ok := v["compression"]; !ok {
+				v["compression"] = ""
+			}
+		}
+		if _, ok := v["local"]; ok {
+			return fmt.Errorf("%s.local is not supported, render the contents inline", at)
+		}
+		for key, value := range v {
+			if err := translateResources(strings.TrimPrefix(at+"."+key, "."), value); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			if err := translateResources(fmt.Sprintf("%s[%d]", at, i), value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dataURL returns text as a data URL, percent-encoding all but the
+// unreserved characters.
+func dataURL(text string) string {
+	var b strings.Builder
+	b.WriteString("data:,")
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// validateIgnition checks the fields Ignition requires of files,
+// directories, links, units, users and groups.
+func validateIgnition(config map[string]interface{}) error {
+	checks := []struct {
+		section, list string
+		required      []string
+	}{
+		{"storage", "files", []string{"path"}},
+		{"storage", "directories", []string{"path"}},
+		{"storage", "links", []string{"path", "target"}},
+		{"systemd", "units", []string{"name"}},
+		{"passwd", "users", []string{"name"}},
+		{"passwd", "groups", []string{"name"}},
+	}
+	for _, check := range checks {
+		section, ok := config[check.section].(map[string]interface{})
+		if !ok {
+			if _, set := config[check.section]; set {
+				return fmt.Errorf("%s must be a map", check.section)
+			}
+			continue
+		}
+		list, ok := section[check.list].([]interface{})
+		if !ok {
+			if _, set := section[check.list]; set {
+				return fmt.Errorf("%s.%s must be a list", check.section, check.list)
+			}
+			continue
+		}
+		for i, item := range list {
+			at := fmt.Sprintf("%s.%s[%d]", check.section, check.list, i)
+			entry, ok := item.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s must be a map", at)
+			}
+			for _, field := range check.required {
+				if value, _ := entry[field].(string); value == "" {
+					return fmt.Errorf("%s.%s is required", at, field)
+				}
+			}
+			if p, _ := entry["path"].(string); p != "" && !path.IsAbs(p) {
+				return fmt.Errorf("%s.path %q must be absolute", at, p)
+			}
+			if mode, ok := entry["mode"]; ok {
+				if _, ok := mode.(int); !ok {
+					return fmt.Errorf("%s.mode must be a number, such as 0644", at)
+				}
+			}
+			if name, _ := entry["name"].(string); check.list == "units" && !strings.Contains(name, ".") {
+				return fmt.Errorf("%s.name %q needs a unit type suffix, such as .service", at, name)
+			}
+		}
+	}
+	return nil
+}
+
+// mergeIgnition merges the child config onto parent: maps are merged key
+// by key, list entries with the same path, name or device are merged and
+// other entries appended, and the child's other values win. The Ignition
+// version is the newer of the two, which reads both.
+func mergeIgnition(parent, child interface{}) interface{} {
+	switch c := child.(type) {
+	case map[string]interface{}:
+		p, ok := parent.(map[string]interface{})
+		if !ok {
+			return c
+		}
+		merged := make(map[string]interface{}, len(p)+len(c))
+		for key, value := range p {
+			merged[key] = value
+		}
+		for key, value := range c {
+			if old, ok := merged[key]; ok {
+				if key == "version" {
+					if oldVersion, _ := old.(string); oldVersion > fmt.Sprint(value) {
+						continue
+					}
+				}
+				value = mergeIgnition(old, value)
+			}
+			merged[key] = value
+		}
+		return merged
+	case []interface{}:
+		p, ok := parent.([]interface{})
+		if !ok {
+			return c
+		}
+		merged := append([]interface{}{}, p...)
+		for _, item := range c {
+			if i := ignitionEntryIndex(merged, item); i >= 0 {
+				merged[i] = mergeIgnition(merged[i], item)
+			} else {
+				merged = append(merged, item)
+			}
+		}
+		return merged
+	default:
+		return child
+	}
+}
+
+// ignitionEntryIndex returns the index of the entry of list that item
+// merges with: the entry with the same path, name or device, or for other
+// values an equal one. It returns -1 if there is none.
+func ignitionEntryIndex(list []interface{}, item interface{}) int {
+	m, isMap := item.(map[string]interface{})
+	key := ""
+	if isMap {
+		for _, k := range ignitionListKeys {
+			if _, ok := m[k]; ok {
+				key = k
+				break
+			}
+		}
+		if key == "" {
+			return -1
+		}
+	}
+	for i, entry := range list {
+		if !isMap {
+			if reflect.DeepEqual(entry, item) {
+				return i
+			}
+			continue
+		}
+		if e, ok := entry.(map[string]interface{}); ok && reflect.DeepEqual(e[key], m[key]) {
+			return i
+		}
+	}
+	return -1
+}
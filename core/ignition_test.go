@@ -0,0 +1,119 @@
+package core
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The Ignition configs are the ones Butane writes for these configs, as
+// in the examples of its documentation: camelCase keys, and short inline
+// contents as uncompressed data URLs.
+func TestTranslateButane(t *testing.T) {
+	for _, test := range []struct {
+		name, butane, want string
+	}{
+		{"user and hostname", `
+variant: fcos
+version: 1.4.0
+passwd:
+  users:
+    - name: core
+      ssh_authorized_keys:
+        - ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGf core@example
+      password_hash: $6$rounds=4096$saltsalt$hash
+storage:
+  files:
+    - path: /etc/hostname
+      mode: 0644
+      contents:
+        inline: fcos01
+`, `{"ignition":{"version":"3.3.0"},"passwd":{"users":[{"name":"core","passwordHash":"$6$rounds=4096$saltsalt$hash","sshAuthorizedKeys":["ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGf core@example"]}]},"storage":{"files":[{"path":"/etc/hostname","contents":{"compression":"","source":"data:,fcos01"},"mode":420}]}}`},
+		{"disk, filesystem and kernel arguments", `
+variant: fcos
+version: 1.5.0
+storage:
+  disks:
+    - device: /dev/vdb
+      wipe_table: true
+      partitions:
+        - label: var
+          number: 1
+          start_mib: 0
+          size_mib: 0
+  filesystems:
+    - device: /dev/disk/by-partlabel/var
+      path: /var
+      format: xfs
+      wipe_filesystem: true
+      mount_options:
+        - noatime
+kernel_arguments:
+  should_exist:
+    - mitigations=auto
+  should_not_exist:
+    - quiet
+`, `{"ignition":{"version":"3.4.0"},"kernelArguments":{"shouldExist":["mitigations=auto"],"shouldNotExist":["quiet"]},"storage":{"disks":[{"device":"/dev/vdb","partitions":[{"label":"var","number":1,"sizeMiB":0,"startMiB":0}],"wipeTable":true}],"filesystems":[{"device":"/dev/disk/by-partlabel/var","format":"xfs","mountOptions":["noatime"],"path":"/var","wipeFilesystem":true}]}}`},
+		{"unit and appended file", `
+variant: flatcar
+version: 1.0.0
+systemd:
+  units:
+    - name: docker.service
+      enabled: true
+      dropins:
+        - name: proxy.conf
+          contents: |
+            [Service]
+            Environment=HTTP_PROXY=http://proxy:3128
+storage:
+  files:
+    - path: /etc/motd
+      append:
+        - inline: "hello world\n"
+`, `{"ignition":{"version":"3.3.0"},"storage":{"files":[{"append":[{"compression":"","source":"data:,hello%20world%0A"}],"path":"/etc/motd"}]},"systemd":{"units":[{"dropins":[{"contents":"[Service]\nEnvironment=HTTP_PROXY=http://proxy:3128\n","name":"proxy.conf"}],"enabled":true,"name":"docker.service"}]}}`},
+	} {
+		config, err := translateButane([]byte(test.butane))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		got, err := json.Marshal(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var gotValue, wantValue interface{}
+		if err := json.Unmarshal(got, &gotValue); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(test.want), &wantValue); err != nil {
+			t.Fatalf("%s: want: %s", test.name, err)
+		}
+		if !reflect.DeepEqual(gotValue, wantValue) {
+			t.Errorf("%s:\n got %s\nwant %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestTranslateButaneRejects(t *testing.T) {
+	for _, test := range []struct {
+		butane, want string
+	}{
+		{"variant: fcos\nversion: 1.4.0\nboot_device:\n  mirror:\n    devices: [/dev/sda, /dev/sdb]\n",
+			"boot_device is not supported"},
+		{"variant: fcos\nversion: 1.4.0\nstorage:\n  filesystems:\n    - device: /dev/vdb1\n      path: /var\n      with_mount_unit: true\n",
+			"storage.filesystems[0].with_mount_unit is not supported"},
+		{"variant: fcos\nversion: 1.4.0\nstorage:\n  trees:\n    - local: etc\n",
+			"storage.trees is not supported"},
+		{"variant: fcos\nversion: 1.4.0\npasswd:\n  users:\n    - name: core\n      ssh_authorized_keys_local: [id.pub]\n",
+			"passwd.users[0].ssh_authorized_keys_local is not supported"},
+		{"variant: fcos\nversion: 1.4.0\nstorage:\n  files:\n    - path: /etc/motd\n      contents:\n        local: motd\n",
+			"storage.files[0].contents.local is not supported"},
+		{"variant: fcos\nversion: 9.9.9\n", `version "9.9.9" of variant fcos is not supported`},
+	} {
+		if _, err := translateButane([]byte(test.butane)); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("translateButane(%q) = %v, want %s", test.butane, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Install event types reported by the installers.
+const (
+	EventStart    = "start"
+	EventProgress = "progress"
+	EventSuccess  = "success"
+	EventFailure  = "failure"
+)
+
+// maxEventLogSize is the largest log snippet kept with an event; longer
+// snippets keep their tail, where the errors usually are.
+const maxEventLogSize = 16 << 10
+
+// InstallEvent is a report sent by an installer running on a host.
+type InstallEvent struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Stage    string    `json:"stage,omitempty"` // e.g. pre, packages, post
+	Message  string    `json:"message,omitempty"`
+	Progress int       `json:"progress,omitempty"` // percent done, if known
+	Log      string    `json:"log,omitempty"`
+	Client   string    `json:"client,omitempty"` // address the report came from
+}
+
+// validate checks the event type and trims the log snippet.
+func (e *InstallEvent) validate() error {
+	switch e.Type {
+	case EventStart, EventProgress, EventSuccess, EventFailure:
+	default:
+		return fmt.Errorf("event type %q is not one of start, progress, success or failure", e.Type)
+	}
+	if e.Progress < 0 || e.Progress > 100 {
+		return fmt.Errorf("progress %d is not between 0 and 100", e.Progress)
+	}
+	if len(e.Log) > maxEventLogSize {
+		e.Log = e.Log[len(e.Log)-maxEventLogSize:]
+	}
+	return nil
+}
+
+// installEventLog keeps the latest install events of every host and
+// stores them in one JSON lines file per host.
+type installEventLog struct {
+	lock   sync.Mutex
+	dir    string
+	keep   int
+	events map[string][]InstallEvent // by MAC address, oldest first
+}
+
+func newInstallEventLog(dir string, keep int) *installEventLog {
+	return &installEventLog{
+		dir:    dir,
+		keep:   keep,
+		events: make(map[string][]InstallEvent),
+	}
+}
+
+// fileName returns the event file of a host.
+func (l *installEventLog) fileName(mac string) string {
+	return filepath.Join(l.dir, strings.Replace(mac, ":", "-", -1)+".jsonl")
+}
+
+// load reads the event files. A missing directory holds no events.
+func (l *installEventLog) load() error {
+	files, err := ioutil.ReadDir(l.dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".jsonl" {
+			continue
+		}
+		mac, err := normalizeMAC(strings.TrimSuffix(file.Name(), ".jsonl"))
+		if err != nil {
+			continue
+		}
+		events, err := readEventFile(filepath.Join(l.dir, file.Name()))
+		if err != nil {
+			return err
+		}
+		if len(events) > l.keep {
+			events = events[len(events)-l.keep:]
+		}
+		l.events[mac] = events
+	}
+	return nil
+}
+
+func readEventFile(fileName string) ([]InstallEvent, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var events []InstallEvent
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 4*maxEventLogSize)
+	for line := 1; scanner.Scan(); line++ {
+		var event InstallEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", fileName, line, err)
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
+
+// Add records an event of a host. The event file is appended to, and
+// rewritten with the latest events once it holds more than keep.
+func (l *installEventLog) Add(mac string, event InstallEvent) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	events := append(l.events[mac], event)
+	if err := os.MkdirAll(l.dir, os.ModePerm); err != nil {
+		return err
+	}
+	if len(events) > l.keep {
+		events = events[len(events)-l.keep:]
+		l.events[mac] = events
+		var data []byte
+		for _, e := range events {
+			line, _ := json.Marshal(e)
+			data = append(append(data, line...), '\n')
+		}
+		return writeFileAtomic(l.fileName(mac), data, 0644)
+	}
+	l.events[mac] = events
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.fileName(mac), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Get returns the events of a host, oldest first.
+func (l *installEventLog) Get(mac string) []InstallEvent {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]InstallEvent{}, l.events[mac]...)
+}
+
+// Last returns the latest event of a host.
+func (l *installEventLog) Last(mac string) (InstallEvent, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	events := l.events[mac]
+	if len(events) == 0 {
+		return InstallEvent{}, false
+	}
+	return events[len(events)-1], true
+}
+
+// eventStates maps the install event types to the provisioning state they
+// move the host to.
+var eventStates = map[string]string{
+	EventStart:   StateInstalling,
+	EventSuccess: StateInstalled,
+	EventFailure: StateFailed,
+}
+
+// knownHost reports whether the installer callbacks of mac are accepted:
+// it must be a host of the inventory, or a host found by its UUID or
+// serial number that has been handed its boot config.
+func (s *Service) knownHost(mac string) bool {
+	if _, _, ok := s.inventory.lookup(mac); ok {
+		return true
+	}
+	return s.provision.Get(mac).State != StateDiscovered
+}
+
+// fromHost reports whether an installer callback of mac comes from the
+// host: from its leased or reserved address, or with one of its install
+// tokens in the token query parameter.
+func (s *Service) fromHost(r *http.Request, mac string) bool {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	return s.addressMAC(client) == mac || s.installTokens.valid(r.URL.Query().Get("token"), mac)
+}
+
+// serveInstallEvent records an event reported by the installer of a host
+// and updates its provisioning state.
+func (s *Service) serveInstallEvent(w http.ResponseWriter, r *http.Request, mac string) {
+	r.Body = http.MaxBytesReader(w, r.Body, 4*maxEventLogSize)
+	event, err := parseInstallEvent(r)
+	if err == nil {
+		err = event.validate()
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.installEvents.Add(mac, *event); err != nil {
+		s.Logger.Errorf("[HTTP] could not store install event of %s: %s", mac, err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	fields := Fields{"mac": mac, "event": event.Type, "stage": event.Stage, "progress": event.Progress}
+	switch event.Type {
+	case EventFailure:
+		s.Logger.Warning(withFields(fields, "[HTTP] host %s install failed at %q: %s", mac, event.Stage, event.Message))
+	default:
+		s.Logger.Info(withFields(fields, "[HTTP] host %s install %s at %q: %s", mac, event.Type, event.Stage, event.Message))
+	}
+	status := s.provision.Get(mac)
+	if state, ok := eventStates[event.Type]; ok {
+		if status, err = s.provision.Advance(mac, state); err != nil {
+			s.Logger.Warningf("[HTTP] install event of %s not applied: %s", mac, err)
+		}
+	}
+	s.bus.Publish(BusEvent{
+		Time:    event.Time,
+		Topic:   topicInstallPrefix + event.Type,
+		MAC:     mac,
+		IP:      event.Client,
+		Message: event.Message,
+		Data: map[string]interface{}{
+			"stage":    event.Stage,
+			"progress": event.Progress,
+			"state":    status.State,
+		},
+	})
+	writeJSON(w, http.StatusOK, status)
+}
+
+// parseInstallEvent reads an event from a JSON body, from form values, or
+// from query parameters with the body taken as the log snippet. The last
+// form suits installers without a way to url-encode a log file.
+func parseInstallEvent(r *http.Request) (*InstallEvent, error) {
+	event := &InstallEvent{}
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch contentType {
+	case "application/json":
+		if err := json.NewDecoder(r.Body).Decode(event); err != nil {
+			return nil, fmt.Errorf("invalid event: %s", err)
+		}
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		if err := r.ParseMultipartForm(4 * maxEventLogSize); err != nil && err != http.ErrNotMultipart {
+			return nil, fmt.Errorf("invalid event: %s", err)
+		}
+		if err := eventFromValues(event, r.Form.Get); err != nil {
+			return nil, err
+		}
+		event.Log = r.Form.Get("log")
+	default:
+		query := r.URL.Query()
+		if err := eventFromValues(event, query.Get); err != nil {
+			return nil, err
+		}
+		log, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid event: %s", err)
+		}
+		event.Log = string(log)
+		if event.Log == "" {
+			event.Log = query.Get("log")
+		}
+	}
+	event.Time = time.Now()
+	event.Client, _, _ = net.SplitHostPort(r.RemoteAddr)
+	return event, nil
+}
+
+func eventFromValues(event *InstallEvent, get func(string) string) error {
+	event.Type = get("type")
+	event.Stage = get("stage")
+	event.Message = get("message")
+	if progress := get("progress"); progress != "" {
+		n, err := strconv.Atoi(progress)
+		if err != nil {
+			return fmt.Errorf("invalid progress %q", progress)
+		}
+		event.Progress = n
+	}
+	return nil
+}
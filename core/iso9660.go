@@ -0,0 +1,531 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	isoSectorSize          = 2048
+	isoFirstVolumeSector   = 16
+	isoVolumePrimary       = 1
+	isoVolumeSupplementary = 2
+	isoVolumeTerminator    = 255
+	isoFlagDirectory       = 0x02
+	isoFlagMultiExtent     = 0x80
+)
+
+// isoImage is a read-only ISO9660 filesystem read directly from an image
+// file. Rock Ridge names are preferred when present, then Joliet names,
+// then plain ISO9660 names.
+type isoImage struct {
+	file      *os.File
+	name      string
+	root      *isoEntry
+	joliet    bool
+	rockRidge bool
+	suspSkip  int
+	dirs      map[uint32][]*isoEntry
+	dirsLock  sync.Mutex
+}
+
+// isoEntry is a file or directory inside an ISO image.
+type isoEntry struct {
+	name    string
+	extents []isoExtent
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+type isoExtent struct {
+	lba  uint32
+	size int64
+}
+
+// openISOImage opens an ISO image and reads its volume descriptors.
+func openISOImage(name string) (*isoImage, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	img := &isoImage{
+		file: f,
+		name: name,
+		dirs: make(map[uint32][]*isoEntry),
+	}
+	if err := img.readVolumeDescriptors(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	return img, nil
+}
+
+// Close releases the image file.
+func (img *isoImage) Close() error {
+	return img.file.Close()
+}
+
+func (img *isoImage) readVolumeDescriptors() error {
+	var primary, joliet *isoEntry
+	sector := make([]byte, isoSectorSize)
+	for i := int64(isoFirstVolumeSector); ; i++ {
+		if _, err := img.file.ReadAt(sector, i*isoSectorSize); err != nil {
+			return fmt.Errorf("reading volume descriptor: %s", err)
+		}
+		if string(sector[1:6]) != "CD001" {
+			return errors.New("not an ISO9660 image")
+		}
+		switch sector[0] {
+		case isoVolumePrimary:
+			if blockSize := binary.LittleEndian.Uint16(sector[128:130]); blockSize != isoSectorSize {
+				return fmt.Errorf("unsupported logical block size %d", blockSize)
+			}
+			primary, _ = parseISORecord(sector[156:190], false)
+		case isoVolumeSupplementary:
+			escape := string(sector[88:91])
+			if escape == "%/@" || escape == "%/C" || escape == "%/E" {
+				joliet, _ = parseISORecord(sector[156:190], true)
+			}
+		}
+		if sector[0] == isoVolumeTerminator {
+			break
+		}
+	}
+	if primary == nil {
+		return errors.New("no primary volume descriptor")
+	}
+	img.root = primary
+	if err := img.detectRockRidge(); err != nil {
+		return err
+	}
+	if !img.rockRidge && joliet != nil {
+		img.root = joliet
+		img.joliet = true
+	}
+	return nil
+}
+
+// detectRockRidge looks for the SUSP "SP" entry on the root directory's
+// "." record, which announces Rock Ridge extensions.
+func (img *isoImage) detectRockRidge() error {
+	data, err := img.readExtent(img.root.extents[0])
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	length := int(data[0])
+	if length < 34 || length > len(data) {
+		return nil
+	}
+	record := data[:length]
+	systemUse := record[34:]
+	if len(systemUse) >= 7 && string(systemUse[0:2]) == "SP" && systemUse[4] == 0xBE && systemUse[5] == 0xEF {
+		img.rockRidge = true
+		img.suspSkip = int(systemUse[6])
+	}
+	return nil
+}
+
+func (img *isoImage) readExtent(extent isoExtent) ([]byte, error) {
+	data := make([]byte, extent.size)
+	if _, err := img.file.ReadAt(data, int64(extent.lba)*isoSectorSize); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readDir returns the entries of a directory, reading it on first use.
+func (img *isoImage) readDir(dir *isoEntry) ([]*isoEntry, error) {
+	lba := dir.extents[0].lba
+	img.dirsLock.Lock()
+	entries, ok := img.dirs[lba]
+	img.dirsLock.Unlock()
+	if ok {
+		return entries, nil
+	}
+
+	data, err := img.readExtent(dir.extents[0])
+	if err != nil {
+		return nil, err
+	}
+	var last *isoEntry
+	for offset := 0; offset < len(data); {
+		length := int(data[offset])
+		if length == 0 {
+			// Records never cross sector boundaries; skip the padding.
+			offset = (offset/isoSectorSize + 1) * isoSectorSize
+			continue
+		}
+		if offset+length > len(data) {
+			break
+		}
+		record := data[offset : offset+length]
+		offset += length
+		entry, multiExtent := parseISORecord(record, img.joliet)
+		if entry == nil {
+			continue
+		}
+		if img.rockRidge {
+			if name, err := img.rockRidgeName(record); err != nil {
+				return nil, err
+			} else if name != "" {
+				entry.name = name
+			}
+		}
+		if last != nil && last.name == entry.name && !entry.isDir {
+			// Continuation of a multi-extent file.
+			last.extents = append(last.extents, entry.extents...)
+			last.size += entry.size
+		} else {
+			entries = append(entries, entry)
+		}
+		if multiExtent {
+			last = entries[len(entries)-1]
+		} else {
+			last = nil
+		}
+	}
+
+	img.dirsLock.Lock()
+	img.dirs[lba] = entries
+	img.dirsLock.Unlock()
+	return entries, nil
+}
+
+// rockRidgeName returns the Rock Ridge "NM" alternate name of a record,
+// following "CE" continuation areas.
+func (img *isoImage) rockRidgeName(record []byte) (string, error) {
+	nameLength := int(record[32])
+	start := 33 + nameLength
+	if nameLength%2 == 0 {
+		start++
+	}
+	start += img.suspSkip
+	if start >= len(record) {
+		return "", nil
+	}
+	area := record[start:]
+	var name []byte
+	for hops := 0; hops < 16; hops++ {
+		var next *isoExtent
+		var nextOffset int
+		for len(area) >= 4 {
+			length := int(area[2])
+			if length < 4 || length > len(area) {
+				break
+			}
+			entry := area[:length]
+			switch string(entry[0:2]) {
+			case "NM":
+				if length > 5 && entry[4]&0x06 == 0 {
+					name = append(name, entry[5:]...)
+				}
+			case "CE":
+				if length >= 28 {
+					next = &isoExtent{
+						lba:  binary.LittleEndian.Uint32(entry[4:8]),
+						size: int64(binary.LittleEndian.Uint32(entry[20:24])),
+					}
+					nextOffset = int(binary.LittleEndian.Uint32(entry[12:16]))
+				}
+			case "ST":
+				area = nil
+				continue
+			}
+			area = area[length:]
+		}
+		if next == nil {
+			break
+		}
+		data := make([]byte, next.size)
+		if _, err := img.file.ReadAt(data, int64(next.lba)*isoSectorSize+int64(nextOffset)); err != nil && err != io.EOF {
+			return "", err
+		}
+		area = data
+	}
+	return string(name), nil
+}
+
+// parseISORecord decodes a directory record and reports whether more
+// extents of the same file follow. It returns nil for malformed records.
+func parseISORecord(record []byte, joliet bool) (*isoEntry, bool) {
+	if len(record) < 34 {
+		return nil, false
+	}
+	nameLength := int(record[32])
+	if 33+nameLength > len(record) {
+		return nil, false
+	}
+	rawName := record[33 : 33+nameLength]
+	flags := record[25]
+	entry := &isoEntry{
+		extents: []isoExtent{{
+			lba:  binary.LittleEndian.Uint32(record[2:6]),
+			size: int64(binary.LittleEndian.Uint32(record[10:14])),
+		}},
+		size:    int64(binary.LittleEndian.Uint32(record[10:14])),
+		modTime: parseISOTime(record[18:25]),
+		isDir:   flags&isoFlagDirectory != 0,
+	}
+	if nameLength == 1 && (rawName[0] == 0 || rawName[0] == 1) {
+		// "." and ".." of a directory; the root record is also named "\x00".
+		entry.name = string(rawName)
+		return entry, false
+	}
+	if joliet {
+		units := make([]uint16, nameLength/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(rawName[2*i:])
+		}
+		entry.name = string(utf16.Decode(units))
+	} else {
+		entry.name = string(rawName)
+	}
+	if !entry.isDir {
+		if i := strings.LastIndexByte(entry.name, ';'); i >= 0 {
+			entry.name = entry.name[:i]
+		}
+		entry.name = strings.TrimSuffix(entry.name, ".")
+	}
+	if !joliet {
+		entry.name = strings.ToLower(entry.name)
+	}
+	return entry, flags&isoFlagMultiExtent != 0
+}
+
+func parseISOTime(b []byte) time.Time {
+	offset := time.Duration(int8(b[6])) * 15 * time.Minute
+	zone := time.FixedZone("", int(offset.Seconds()))
+	return time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, zone)
+}
+
+// lookup resolves a slash separated path inside the image.
+func (img *isoImage) lookup(name string) (*isoEntry, error) {
+	entry := img.root
+	for _, part := range strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		if !entry.isDir {
+			return nil, os.ErrNotExist
+		}
+		entries, err := img.readDir(entry)
+		if err != nil {
+			return nil, err
+		}
+		var found *isoEntry
+		for _, e := range entries {
+			if e.name == part || (!img.rockRidge && !img.joliet && strings.EqualFold(e.name, part)) {
+				found = e
+				break
+			}
+		}
+		if found == nil {
+			return nil, os.ErrNotExist
+		}
+		entry = found
+	}
+	return entry, nil
+}
+
+// Open implements http.FileSystem.
+func (img *isoImage) Open(name string) (http.File, error) {
+	entry, err := img.lookup(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &isoFile{image: img, entry: entry}, nil
+}
+
+// isoFile is an open file or directory inside an ISO image.
+type isoFile struct {
+	image     *isoImage
+	entry     *isoEntry
+	offset    int64
+	dirOffset int
+}
+
+func (f *isoFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// ReadAt reads across the extents that make up the file.
+func (f *isoFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.entry.isDir {
+		return 0, errors.New("is a directory")
+	}
+	if off >= f.entry.size {
+		return 0, io.EOF
+	}
+	read := 0
+	for _, extent := range f.entry.extents {
+		if len(p) == 0 {
+			break
+		}
+		if off >= extent.size {
+			off -= extent.size
+			continue
+		}
+		chunk := p
+		if int64(len(chunk)) > extent.size-off {
+			chunk = chunk[:extent.size-off]
+		}
+		n, err := f.image.file.ReadAt(chunk, int64(extent.lba)*isoSectorSize+off)
+		read += n
+		if err != nil {
+			return read, err
+		}
+		p = p[n:]
+		off = 0
+	}
+	if len(p) > 0 {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+func (f *isoFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.entry.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *isoFile) Close() error { return nil }
+
+func (f *isoFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.entry.isDir {
+		return nil, errors.New("not a directory")
+	}
+	entries, err := f.image.readDir(f.entry)
+	if err != nil {
+		return nil, err
+	}
+	var infos []os.FileInfo
+	for f.dirOffset < len(entries) && (count <= 0 || len(infos) < count) {
+		e := entries[f.dirOffset]
+		f.dirOffset++
+		if e.name == "\x00" || e.name == "\x01" {
+			continue
+		}
+		infos = append(infos, isoFileInfo{e})
+	}
+	if count > 0 && len(infos) == 0 {
+		return nil, io.EOF
+	}
+	return infos, nil
+}
+
+func (f *isoFile) Stat() (os.FileInfo, error) {
+	return isoFileInfo{f.entry}, nil
+}
+
+// isoFileInfo implements os.FileInfo for an ISO entry.
+type isoFileInfo struct {
+	entry *isoEntry
+}
+
+func (fi isoFileInfo) Name() string       { return fi.entry.name }
+func (fi isoFileInfo) Size() int64        { return fi.entry.size }
+func (fi isoFileInfo) ModTime() time.Time { return fi.entry.modTime }
+func (fi isoFileInfo) IsDir() bool        { return fi.entry.isDir }
+func (fi isoFileInfo) Sys() interface{}   { return nil }
+
+func (fi isoFileInfo) Mode() os.FileMode {
+	if fi.entry.isDir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+
+// isoMount maps a URL/TFTP path prefix onto an ISO image.
+type isoMount struct {
+	prefix string
+	image  *isoImage
+}
+
+// isoFileSystem routes requests below a mount prefix into the matching ISO
+// image and everything else to the underlying filesystem.
+type isoFileSystem struct {
+	mounts []isoMount
+	base   http.FileSystem
+}
+
+func (fs isoFileSystem) Open(name string) (http.File, error) {
+	if img, inner, ok := findISOMount(fs.mounts, name); ok {
+		return img.Open(inner)
+	}
+	return fs.base.Open(name)
+}
+
+// findISOMount returns the image serving name and the path inside it.
+func findISOMount(mounts []isoMount, name string) (*isoImage, string, bool) {
+	name = path.Clean("/" + strings.Replace(name, "\\", "/", -1))
+	for _, m := range mounts {
+		if name == m.prefix || strings.HasPrefix(name, m.prefix+"/") {
+			return m.image, strings.TrimPrefix(name, m.prefix), true
+		}
+	}
+	return nil, "", false
+}
+
+// ISOMountConfig maps a path prefix below the HTTP/TFTP root to an ISO image.
+type ISOMountConfig struct {
+	Prefix string `mapstructure:"prefix"`
+	Image  string `mapstructure:"image"`
+}
+
+// loadISOMounts opens every configured image. Relative image paths are
+// resolved against docRoot.
+func loadISOMounts(docRoot string, config []ISOMountConfig) ([]isoMount, error) {
+	var mounts []isoMount
+	for _, c := range config {
+		image := c.Image
+		if !filepath.IsAbs(image) {
+			image = filepath.Join(docRoot, image)
+		}
+		img, err := openISOImage(image)
+		if err != nil {
+			for _, m := range mounts {
+				m.image.Close()
+			}
+			return nil, err
+		}
+		mounts = append(mounts, isoMount{prefix: path.Clean("/" + c.Prefix), image: img})
+	}
+	// Longest prefix first so nested mounts win.
+	for i := 1; i < len(mounts); i++ {
+		for j := i; j > 0 && len(mounts[j].prefix) > len(mounts[j-1].prefix); j-- {
+			mounts[j], mounts[j-1] = mounts[j-1], mounts[j]
+		}
+	}
+	return mounts, nil
+}
+
+var _ http.File = (*isoFile)(nil)
+var _ io.ReaderAt = (*isoFile)(nil)
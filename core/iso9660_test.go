@@ -0,0 +1,197 @@
+package core
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// The images in testdata are written by testdata/mkiso.py.
+
+func readISOFile(t *testing.T, img *isoImage, name string) string {
+	t.Helper()
+	f, err := img.Open(name)
+	if err != nil {
+		t.Fatalf("Open(%q): %s", name, err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("reading %s: %s", name, err)
+	}
+	return string(data)
+}
+
+func readISODir(t *testing.T, img *isoImage, name string) []string {
+	t.Helper()
+	f, err := img.Open(name)
+	if err != nil {
+		t.Fatalf("Open(%q): %s", name, err)
+	}
+	defer f.Close()
+	infos, err := f.Readdir(-1)
+	if err != nil {
+		t.Fatalf("Readdir(%q): %s", name, err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestISOImageNames(t *testing.T) {
+	for _, test := range []struct {
+		image     string
+		rockRidge bool
+		joliet    bool
+	}{
+		{"rockridge.iso", true, false},
+		{"joliet.iso", false, true},
+	} {
+		t.Run(test.image, func(t *testing.T) {
+			img, err := openISOImage(filepath.Join("testdata", test.image))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer img.Close()
+			if img.rockRidge != test.rockRidge || img.joliet != test.joliet {
+				t.Errorf("rockRidge, joliet = %v, %v, want %v, %v", img.rockRidge, img.joliet, test.rockRidge, test.joliet)
+			}
+			if got, want := readISODir(t, img, "/"), []string{"README.txt", "isolinux"}; !equalStrings(got, want) {
+				t.Errorf("root = %q, want %q", got, want)
+			}
+			if got, want := readISODir(t, img, "/isolinux"), []string{"vmlinuz"}; !equalStrings(got, want) {
+				t.Errorf("isolinux = %q, want %q", got, want)
+			}
+			if got, want := readISOFile(t, img, "/isolinux/vmlinuz"), "kernel image\n"; got != want {
+				t.Errorf("vmlinuz = %q, want %q", got, want)
+			}
+			if got, want := readISOFile(t, img, "README.txt"), "pxesrv test image\n"; got != want {
+				t.Errorf("README.txt = %q, want %q", got, want)
+			}
+			f, err := img.Open("/README.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, _ := f.Stat()
+			if want := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC); !info.ModTime().Equal(want) || info.Size() != 18 {
+				t.Errorf("README.txt modified %s, size %d, want %s, 18", info.ModTime(), info.Size(), want)
+			}
+			if _, err := img.Open("/isolinux/missing"); !os.IsNotExist(err) {
+				t.Errorf("Open of a missing file: %v, want not exist", err)
+			}
+		})
+	}
+}
+
+func TestISOImageMalformed(t *testing.T) {
+	original, err := ioutil.ReadFile(filepath.Join("testdata", "rockridge.iso"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const primary = isoFirstVolumeSector * isoSectorSize
+	const rootSector = 19 * isoSectorSize
+	for _, test := range []struct {
+		name    string
+		corrupt func(data []byte) []byte
+		wantErr bool
+	}{
+		{"zero size root extent", func(data []byte) []byte {
+			binary.LittleEndian.PutUint32(data[primary+156+10:], 0)
+			return data
+		}, false},
+		{"root record longer than its extent", func(data []byte) []byte {
+			binary.LittleEndian.PutUint32(data[primary+156+10:], 20)
+			return data
+		}, false},
+		{"short root record", func(data []byte) []byte {
+			data[rootSector] = 10
+			return data
+		}, false},
+		{"record past the end of the directory", func(data []byte) []byte {
+			data[rootSector+isoSectorSize-2] = 200
+			return data
+		}, false},
+		{"root extent past the end of the image", func(data []byte) []byte {
+			binary.LittleEndian.PutUint32(data[primary+156+2:], 1000)
+			return data
+		}, false},
+		{"not an ISO9660 image", func(data []byte) []byte {
+			copy(data[primary+1:], "XXXXX")
+			return data
+		}, true},
+		{"truncated volume descriptors", func(data []byte) []byte {
+			return data[:primary+100]
+		}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			data := test.corrupt(append([]byte(nil), original...))
+			dir, err := ioutil.TempDir("", "pxesrv-iso")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			name := filepath.Join(dir, "image.iso")
+			if err := ioutil.WriteFile(name, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			img, err := openISOImage(name)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("openISOImage: %v, want error %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer img.Close()
+			// Lookups may fail but must not panic.
+			if f, err := img.Open("/isolinux/vmlinuz"); err == nil {
+				ioutil.ReadAll(f)
+			}
+			if f, err := img.Open("/"); err == nil {
+				f.Readdir(-1)
+			}
+		})
+	}
+}
+
+func TestFindISOMount(t *testing.T) {
+	outer, inner := &isoImage{name: "outer"}, &isoImage{name: "inner"}
+	mounts := []isoMount{{prefix: "/centos/7/extra", image: inner}, {prefix: "/centos/7", image: outer}}
+	for _, test := range []struct {
+		name, image, path string
+	}{
+		{"/centos/7/images/pxeboot/vmlinuz", "outer", "/images/pxeboot/vmlinuz"},
+		{"centos\\7\\isolinux\\initrd.img", "outer", "/isolinux/initrd.img"},
+		{"/centos/7/extra/x", "inner", "/x"},
+		{"/centos/7", "outer", ""},
+		{"/centos/70/vmlinuz", "", ""},
+		{"/centos/7/../8/vmlinuz", "", ""},
+	} {
+		img, inner, ok := findISOMount(mounts, test.name)
+		got := ""
+		if ok {
+			got = img.name
+		}
+		if got != test.image || inner != test.path {
+			t.Errorf("findISOMount(%q) = %q, %q, want %q, %q", test.name, got, inner, test.image, test.path)
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,125 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+)
+
+// loadLeases restores the unexpired leases saved by saveLeases, except
+// those of addresses reserved for another host since. A missing lease file
+// is not an error.
+func (s *DHCPService) loadLeases(fileName string) (int, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var leases []RecordLease
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return 0, err
+	}
+
+	s.acquireStateLock("loadLeases")
+	defer s.releaseStateLock("loadLeases")
+	count := 0
+	for i := range leases {
+		lease := leases[i]
+		if lease.IsExpired() || lease.IPAddress.To4() == nil || s.isReservedForOther(lease.IPAddress, lease.MACAddress) {
+			continue
+		}
+		s.setLease(&lease)
+		count++
+	}
+	return count, nil
+}
+
+// saveLeases writes the active leases to fileName, replacing it atomically.
+func (s *DHCPService) saveLeases(fileName string) (int, error) {
+	s.acquireStateLock("saveLeases")
+	leases := []RecordLease{}
+	for _, lease := range s.leasesByMACAddress {
+		if !lease.IsExpired() {
+			leases = append(leases, *lease)
+		}
+	}
+	s.releaseStateLock("saveLeases")
+
+	data, err := json.MarshalIndent(leases, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	if err := writeFileAtomic(fileName, data, 0644); err != nil {
+		return 0, err
+	}
+	return len(leases), nil
+}
+
+// Leases returns the active leases sorted by IP address.
+func (s *DHCPService) Leases() []RecordLease {
+	s.acquireStateLock("Leases")
+	defer s.releaseStateLock("Leases")
+	leases := []RecordLease{}
+	for _, lease := range s.leasesByMACAddress {
+		if !lease.IsExpired() {
+			leases = append(leases, *lease)
+		}
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return bytes.Compare(leases[i].IPAddress.To4(), leases[j].IPAddress.To4()) < 0
+	})
+	return leases
+}
+
+// Lease returns the active lease of a MAC address.
+func (s *DHCPService) Lease(clientMACAddress string) (RecordLease, bool) {
+	s.acquireStateLock("Lease")
+	defer s.releaseStateLock("Lease")
+	lease, ok := s.leasesByMACAddress[clientMACAddress]
+	if !ok || lease.IsExpired() {
+		return RecordLease{}, false
+	}
+	return *lease, true
+}
+
+// LeaseByIP returns the active lease of an IP address.
+func (s *DHCPService) LeaseByIP(ip net.IP) (RecordLease, bool) {
+	s.acquireStateLock("LeaseByIP")
+	defer s.releaseStateLock("LeaseByIP")
+	lease, ok := s.leasesByIP[ip.String()]
+	if !ok || lease.IsExpired() {
+		return RecordLease{}, false
+	}
+	return *lease, true
+}
+
+// leasedToOther returns the MAC address of the client other than
+// clientMACAddress with an active lease on ip.
+func (s *DHCPService) leasedToOther(ip net.IP, clientMACAddress string) (string, bool) {
+	s.acquireStateLock("leasedToOther")
+	defer s.releaseStateLock("leasedToOther")
+	for mac, lease := range s.leasesByMACAddress {
+		if mac != clientMACAddress && !lease.IsExpired() && lease.IPAddress.Equal(ip) {
+			return mac, true
+		}
+	}
+	return "", false
+}
+
+// RevokeLease removes the lease of a MAC address; the client is sent a NAK
+// when it next tries to renew it.
+func (s *DHCPService) RevokeLease(clientMACAddress string) (RecordLease, bool) {
+	s.acquireStateLock("RevokeLease")
+	defer s.releaseStateLock("RevokeLease")
+	lease, ok := s.leasesByMACAddress[clientMACAddress]
+	if !ok || lease.IsExpired() {
+		return RecordLease{}, false
+	}
+	s.deleteLease(clientMACAddress)
+	return *lease, true
+}
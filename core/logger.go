@@ -1,8 +1,18 @@
 package core
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/mash/go-accesslog"
 	"github.com/op/go-logging"
@@ -12,29 +22,313 @@ var format = logging.MustStringFormatter(
 	`%{color}%{time:2006-01-02T15:04:05Z07:00} %{level:.5s} %{module:.10s}%{color:reset} %{message}`,
 )
 
-func initLogger(logFilePath, logFileName string) *logging.Logger {
+var plainFormat = logging.MustStringFormatter(
+	`%{time:2006-01-02T15:04:05Z07:00} %{level:.5s} %{module:.10s} %{message}`,
+)
+
+// Log components, taken from the tag that starts a log message. Messages
+// without a tag belong to the PXES component.
+var logComponents = []string{"PXES", "DHCP", "TFTP", "HTTP", "TMPL"}
+
+// logTag matches the component tag of a message, "[DHCP] ...", and the
+// transaction tag of the DHCP handler, "[TXN: 1a2b3c4d] ...".
+var logTag = regexp.MustCompile(`^\[(PXES|DHCP|TFTP|HTTP|TMPL|TXN: ([^\]]*))\] ?`)
+
+// LogConfig configures the log file.
+type LogConfig struct {
+	Format      string            // text or json
+	Level       string            // default level
+	Levels      map[string]string // level by component
+	MaxSize     int64             // rotate when the file grows past this many MB, 0 disables
+	RotateEvery time.Duration     // rotate at this interval, 0 disables
+	MaxBackups  int               // number of rotated files kept, 0 keeps all
+	MaxAge      time.Duration     // rotated files older than this are removed, 0 keeps all
+}
+
+// levels parses the default and per-component levels.
+func (c LogConfig) levels() (map[string]logging.Level, error) {
+	def, err := logging.LogLevel(c.Level)
+	if err != nil {
+		return nil, fmt.Errorf("log.level: %q is not a log level", c.Level)
+	}
+	levels := make(map[string]logging.Level, len(logComponents))
+	for _, component := range logComponents {
+		levels[component] = def
+	}
+	for component, name := range c.Levels {
+		component = strings.ToUpper(component)
+		if _, ok := levels[component]; !ok {
+			return nil, fmt.Errorf("log.levels: unknown component %q, expected one of %s",
+				component, strings.Join(logComponents, ", "))
+		}
+		level, err := logging.LogLevel(name)
+		if err != nil {
+			return nil, fmt.Errorf("log.levels.%s: %q is not a log level", strings.ToLower(component), name)
+		}
+		levels[component] = level
+	}
+	return levels, nil
+}
+
+// validate checks the log configuration.
+func (c LogConfig) validate() error {
+	if c.Format != "text" && c.Format != "json" {
+		return fmt.Errorf("log.format: %q is not one of text or json", c.Format)
+	}
+	if c.MaxSize < 0 || c.RotateEvery < 0 || c.MaxBackups < 0 || c.MaxAge < 0 {
+		return fmt.Errorf("log: max_size, rotate_every, max_backups and max_age cannot be negative")
+	}
+	_, err := c.levels()
+	return err
+}
+
+// Fields are structured values attached to a log message.
+type Fields map[string]interface{}
+
+// logEntry is a log message with structured fields. It is passed as the
+// only argument of a non-formatting logger method, so any backend prints
+// the message, and logBackend also writes the fields.
+type logEntry struct {
+	message string
+	fields  Fields
+}
+
+func (e logEntry) String() string {
+	return e.message
+}
+
+// withFields formats a message and attaches fields to it:
+//
+//	s.Logger.Info(withFields(Fields{"mac": mac}, "[HTTP] boot script for %s", mac))
+func withFields(fields Fields, format string, args ...interface{}) logEntry {
+	return logEntry{message: fmt.Sprintf(format, args...), fields: fields}
+}
+
+// logBackend filters records by component level and writes them as text
+// or JSON lines to the log file, and as text to stderr.
+type logBackend struct {
+	lock   sync.RWMutex
+	levels map[string]logging.Level
+	json   bool
+	file   io.Writer
+	stderr io.Writer
+}
+
+// setLevels replaces the level of each component.
+func (b *logBackend) setLevels(levels map[string]logging.Level) {
+	b.lock.Lock()
+	b.levels = levels
+	b.lock.Unlock()
+}
+
+// Log implements logging.Backend.
+func (b *logBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	message := rec.Message()
+	component := "PXES"
+	fields := Fields{}
+	if m := logTag.FindStringSubmatch(message); m != nil {
+		component = m[1]
+		if m[2] != "" {
+			component = "DHCP"
+			fields["txn"] = m[2]
+		}
+	}
+	b.lock.RLock()
+	threshold := b.levels[component]
+	b.lock.RUnlock()
+	if level > threshold {
+		return nil
+	}
+	if len(rec.Args) == 1 {
+		if entry, ok := rec.Args[0].(logEntry); ok {
+			for k, v := range entry.fields {
+				fields[k] = v
+			}
+		}
+	}
+
+	var text bytes.Buffer
+	plainFormat.Format(calldepth+1, rec, &text)
+	appendFields(&text, fields)
+	text.WriteByte('\n')
+	if b.stderr != nil {
+		var colored bytes.Buffer
+		format.Format(calldepth+1, rec, &colored)
+		appendFields(&colored, fields)
+		colored.WriteByte('\n')
+		b.stderr.Write(colored.Bytes())
+	}
+	if !b.json {
+		_, err := b.file.Write(text.Bytes())
+		return err
+	}
+
+	record := map[string]interface{}{
+		"time":      rec.Time.Format(time.RFC3339Nano),
+		"level":     level.String(),
+		"component": component,
+		"message":   logTag.ReplaceAllString(message, ""),
+	}
+	for k, v := range fields {
+		if _, ok := record[k]; !ok {
+			record[k] = v
+		}
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = b.file.Write(append(line, '\n'))
+	return err
+}
+
+// appendFields writes fields as sorted key=value pairs.
+func appendFields(buf *bytes.Buffer, fields Fields) {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		value := fmt.Sprint(fields[k])
+		if strings.ContainsAny(value, " \"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		fmt.Fprintf(buf, " %s=%s", k, value)
+	}
+}
+
+// rotatingFile is a log file that is rotated by size and age. Rotated
+// files get a timestamp suffix, with a counter if several are rotated
+// within a second, and are removed by count and age.
+type rotatingFile struct {
+	lock        sync.Mutex
+	name        string
+	maxSize     int64
+	rotateEvery time.Duration
+	maxBackups  int
+	maxAge      time.Duration
+	file        *os.File
+	size        int64
+	opened      time.Time
+}
+
+func openRotatingFile(name string, c LogConfig) (*rotatingFile, error) {
+	f := &rotatingFile{
+		name:        name,
+		maxSize:     c.MaxSize << 20,
+		rotateEvery: c.RotateEvery,
+		maxBackups:  c.MaxBackups,
+		maxAge:      c.MaxAge,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = info.ModTime()
+	if f.size == 0 {
+		f.opened = time.Now()
+	}
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.size > 0 && ((f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize) ||
+		(f.rotateEvery > 0 && time.Since(f.opened) >= f.rotateEvery)) {
+		if err := f.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "pxesrv: log rotation failed: %s\n", err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file and opens a new one; the caller holds
+// the lock.
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	// Files rotated within the same second get a counter, which sorts
+	// after the plain timestamp.
+	base := f.name + "." + time.Now().Format("20060102-150405")
+	rotated := base
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(rotated); err != nil {
+			break
+		}
+		rotated = fmt.Sprintf("%s.%03d", base, n)
+	}
+	if err := os.Rename(f.name, rotated); err != nil {
+		f.open()
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	go f.prune()
+	return nil
+}
+
+// prune removes rotated files beyond maxBackups or older than maxAge.
+func (f *rotatingFile) prune() {
+	matches, err := filepath.Glob(f.name + ".*")
+	if err != nil {
+		return
+	}
+	// The timestamp and counter suffixes sort oldest first.
+	sort.Strings(matches)
+	for i, name := range matches {
+		tooMany := f.maxBackups > 0 && i < len(matches)-f.maxBackups
+		tooOld := false
+		if f.maxAge > 0 {
+			if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > f.maxAge {
+				tooOld = true
+			}
+		}
+		if tooMany || tooOld {
+			os.Remove(name)
+		}
+	}
+}
+
+func initLogger(logFilePath, logFileName string, c LogConfig) (*logging.Logger, *logBackend) {
 	fileName := path.Join(logFilePath, logFileName)
 	err := os.MkdirAll(logFilePath, os.ModePerm)
 	if err != nil {
 		panic(err)
 	}
-	_, err = os.Stat(fileName)
-	if os.IsNotExist(err) {
-		// if file not exist, create it
-		os.Create(fileName)
+	logFile, err := openRotatingFile(fileName, c)
+	if err != nil {
+		panic(err)
 	}
-	logFile, err := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0666)
+	levels, err := c.levels()
 	if err != nil {
 		panic(err)
 	}
-	backend1 := logging.NewLogBackend(logFile, "", 0)
-	backend2 := logging.NewLogBackend(os.Stderr, "", 0)
-	backend1Formatter := logging.NewBackendFormatter(backend1, format)
-	backend2Leveled := logging.AddModuleLevel(backend2)
-	backend2Leveled.SetLevel(logging.INFO, "")
-	// Set the backends to be used.
-	logging.SetBackend(backend2Leveled, backend1Formatter)
-	return logging.MustGetLogger("pxesrv")
+	backend := &logBackend{
+		levels: levels,
+		json:   c.Format == "json",
+		file:   logFile,
+		stderr: os.Stderr,
+	}
+	logging.SetBackend(backend)
+	return logging.MustGetLogger("pxesrv"), backend
 }
 
 type logger struct {
@@ -42,5 +336,10 @@ type logger struct {
 }
 
 func (l logger) Log(record accesslog.LogRecord) {
-	l.Logger.Info("[HTTP] " + record.Method + " " + record.Uri)
+	l.Logger.Info(withFields(Fields{
+		"client":   record.Ip,
+		"status":   record.Status,
+		"bytes":    record.Size,
+		"duration": record.ElapsedTime.Round(time.Millisecond).String(),
+	}, "[HTTP] %s %s", record.Method, record.Uri))
 }
@@ -0,0 +1,297 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsPath is the HTTP path of the Prometheus metrics.
+const metricsPath = "/metrics"
+
+// counterVec is a Prometheus counter with labels.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	lock   sync.Mutex
+	values map[string]float64 // by label values joined with \xff
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	if len(labels) == 0 {
+		c.values[""] = 0
+	}
+	return c
+}
+
+// Add adds v to the counter with the given label values.
+func (c *counterVec) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.lock.Lock()
+	c.values[key] += v
+	c.lock.Unlock()
+}
+
+// Inc adds one to the counter with the given label values.
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.lock.Lock()
+	samples := make([]sample, 0, len(c.values))
+	for key, v := range c.values {
+		var values []string
+		if len(c.labels) > 0 {
+			values = strings.Split(key, "\xff")
+		}
+		samples = append(samples, sample{labelValues: values, value: v})
+	}
+	c.lock.Unlock()
+	writeMetric(w, c.name, c.help, "counter", c.labels, samples)
+}
+
+// sample is a value of a metric with its label values.
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+// writeMetric writes a metric in the Prometheus text format.
+func writeMetric(w io.Writer, name, help, kind string, labels []string, samples []sample) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].labelValues, "\xff") < strings.Join(samples[j].labelValues, "\xff")
+	})
+	for _, s := range samples {
+		var pairs []string
+		for i, label := range labels {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", label, s.labelValues[i]))
+		}
+		if len(pairs) > 0 {
+			fmt.Fprintf(w, "%s{%s} %v\n", name, strings.Join(pairs, ","), s.value)
+		} else {
+			fmt.Fprintf(w, "%s %v\n", name, s.value)
+		}
+	}
+}
+
+// metrics holds the counters updated by the servers. Gauges are read from
+// the service state when scraped.
+type metrics struct {
+	dhcpMessages    *counterVec
+	tftpTransfers   *counterVec
+	tftpBytes       *counterVec
+	tftpErrors      *counterVec
+	httpRequests    *counterVec
+	httpBytes       *counterVec
+	templateErrors  *counterVec
+	eventsPublished *counterVec
+	eventDeliveries *counterVec
+	started         time.Time
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		dhcpMessages: newCounterVec("pxesrv_dhcp_messages_total",
+			"DHCP messages received by message type and outcome.", "type", "outcome"),
+		tftpTransfers: newCounterVec("pxesrv_tftp_transfers_total",
+			"Finished TFTP read transfers by outcome.", "outcome"),
+		tftpBytes: newCounterVec("pxesrv_tftp_read_bytes_total",
+			"Bytes of the served files read for TFTP transfers, including blocks the client never acknowledged."),
+		tftpErrors: newCounterVec("pxesrv_tftp_errors_total",
+			"Failed TFTP transfers by TFTP error code (RFC 1350) and the side that raised it.", "code", "source"),
+		httpRequests: newCounterVec("pxesrv_http_requests_total",
+			"HTTP requests by first path element and status code.", "prefix", "code"),
+		httpBytes: newCounterVec("pxesrv_http_response_bytes_total",
+			"HTTP response body bytes by first path element.", "prefix"),
+		templateErrors: newCounterVec("pxesrv_template_render_errors_total",
+			"Template rendering failures."),
+		eventsPublished: newCounterVec("pxesrv_events_published_total",
+			"Events published on the event bus by topic.", "topic"),
+		eventDeliveries: newCounterVec("pxesrv_event_deliveries_total",
+			"Events handed to sinks by sink and outcome (delivered, failed, dropped).", "sink", "outcome"),
+		started: time.Now(),
+	}
+}
+
+// dhcpOutcome names the reply to a DHCP message.
+func dhcpOutcome(response []byte) string {
+	if len(response) == 0 {
+		return "no_reply"
+	}
+	for i := 240; i+2 < len(response); i += 2 + int(response[i+1]) {
+		if response[i] == 53 {
+			switch response[i+2] {
+			case 2:
+				return "offer"
+			case 5:
+				return "ack"
+			case 6:
+				return "nak"
+			}
+		}
+	}
+	return "other"
+}
+
+var clientErrorCode = regexp.MustCompile(`code=(\d+)`)
+
+// tftpErrorCode returns the TFTP error code for the error a transfer
+// failed with, and whether it came from the client.
+func tftpErrorCode(err error) (string, string) {
+	switch {
+	case os.IsNotExist(err):
+		return "1", "server"
+	case os.IsPermission(err):
+		return "2", "server"
+	}
+	if m := clientErrorCode.FindStringSubmatch(err.Error()); m != nil {
+		return m[1], "client"
+	}
+	return "0", "server"
+}
+
+// observeTFTP counts a finished transfer.
+func (m *metrics) observeTFTP(t TFTPTransfer, err error) {
+	m.tftpTransfers.Inc(t.Outcome)
+	m.tftpBytes.Add(float64(t.Bytes))
+	if err != nil {
+		code, source := tftpErrorCode(err)
+		m.tftpErrors.Inc(code, source)
+	}
+}
+
+// handler counts the HTTP requests served by next. Requests answered with
+// 404 are counted under the prefix "other", so that probes for random
+// paths do not create new series.
+func (m *metrics) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mw := &metricsWriter{ResponseWriter: w}
+		next.ServeHTTP(mw, r)
+		if mw.status == 0 {
+			mw.status = http.StatusOK
+		}
+		prefix := "/" + strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+		if mw.status == http.StatusNotFound {
+			prefix = "other"
+		}
+		m.httpRequests.Inc(prefix, fmt.Sprint(mw.status))
+		m.httpBytes.Add(float64(mw.bytes), prefix)
+	})
+}
+
+type metricsWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *metricsWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// serveMetrics writes the metrics in the Prometheus text format.
+func (s *Service) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	m := s.metrics
+	m.dhcpMessages.write(&buf)
+	s.writeLeaseMetrics(&buf)
+	m.tftpTransfers.write(&buf)
+	m.tftpBytes.write(&buf)
+	m.tftpErrors.write(&buf)
+	writeMetric(&buf, "pxesrv_tftp_retransmits_total", "TFTP packets sent again after a timeout.", "counter",
+		nil, []sample{{value: float64(s.tftpTransfers.Retransmits())}})
+	writeMetric(&buf, "pxesrv_tftp_active_transfers", "TFTP transfers in progress.", "gauge",
+		nil, []sample{{value: float64(len(s.tftpTransfers.Active()))}})
+	m.httpRequests.write(&buf)
+	m.httpBytes.write(&buf)
+	writeMetric(&buf, "pxesrv_http_active_transfers", "HTTP downloads in progress.", "gauge",
+		nil, []sample{{value: float64(len(s.httpTransfers.Active()))}})
+	m.templateErrors.write(&buf)
+	m.eventsPublished.write(&buf)
+	m.eventDeliveries.write(&buf)
+	s.writeHostMetrics(&buf)
+	writeMetric(&buf, "pxesrv_start_time_seconds", "Start time of pxesrv since the Unix epoch.", "gauge",
+		nil, []sample{{value: float64(m.started.Unix())}})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// writeLeaseMetrics writes the active and free addresses of the DHCP pool.
+func (s *Service) writeLeaseMetrics(w io.Writer) {
+	if s.dhcpService == nil {
+		return
+	}
+	cfg := s.settings()
+	start := net.ParseIP(cfg.IPRangeStart).To4()
+	end := net.ParseIP(cfg.IPRangeEnd).To4()
+	if start == nil || end == nil {
+		return
+	}
+	first, last := binary.BigEndian.Uint32(start), binary.BigEndian.Uint32(end)
+	active := 0
+	for _, lease := range s.dhcpService.Leases() {
+		if ip := lease.IPAddress.To4(); ip != nil {
+			if n := binary.BigEndian.Uint32(ip); n >= first && n <= last {
+				active++
+			}
+		}
+	}
+	pool := cfg.IPRangeStart + "-" + cfg.IPRangeEnd
+	size := int(last-first) + 1
+	writeMetric(w, "pxesrv_dhcp_leases", "Addresses of the DHCP pool by state.", "gauge",
+		[]string{"pool", "state"}, []sample{
+			{labelValues: []string{pool, "active"}, value: float64(active)},
+			{labelValues: []string{pool, "free"}, value: float64(size - active)},
+		})
+}
+
+// writeHostMetrics writes the number of hosts in each provisioning state.
+// Known hosts that were never seen count as discovered.
+func (s *Service) writeHostMetrics(w io.Writer) {
+	counts := map[string]int{
+		StateDiscovered: 0,
+		StateInstalling: 0,
+		StateInstalled:  0,
+		StateFailed:     0,
+		StateLocalBoot:  0,
+	}
+	seen := make(map[string]bool)
+	for _, status := range s.provision.All() {
+		counts[status.State]++
+		seen[status.MAC] = true
+	}
+	for _, host := range s.inventory.Hosts() {
+		if !seen[host.MAC] {
+			counts[StateDiscovered]++
+		}
+	}
+	var samples []sample
+	for state, n := range counts {
+		samples = append(samples, sample{labelValues: []string{state}, value: float64(n)})
+	}
+	writeMetric(w, "pxesrv_hosts", "Hosts by provisioning state.", "gauge", []string{"state"}, samples)
+}
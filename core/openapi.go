@@ -0,0 +1,237 @@
+package core
+
+// openAPISpec describes the HTTP API, served at /api/v1/openapi.json.
+const openAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "pxesrv API",
+    "version": "1",
+    "description": "Management API of pxesrv. Requests need 'Authorization: Bearer <api.token>' when api.token is set, except for this document and the installer callbacks. Without api.token the other endpoints only answer GET; changes are refused with 403."
+  },
+  "servers": [{"url": "/api/v1"}],
+  "security": [{"token": []}],
+  "paths": {
+    "/leases": {
+      "get": {
+        "summary": "List the active DHCP leases",
+        "responses": {"200": {"description": "Leases sorted by address", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Lease"}}}}}}
+      }
+    },
+    "/leases/{mac}": {
+      "parameters": [{"$ref": "#/components/parameters/mac"}],
+      "get": {
+        "summary": "Show the lease of a MAC address",
+        "responses": {"200": {"$ref": "#/components/responses/Lease"}, "404": {"$ref": "#/components/responses/Error"}}
+      },
+      "delete": {
+        "summary": "Revoke a lease; the client is refused when it renews",
+        "responses": {"200": {"$ref": "#/components/responses/Lease"}, "404": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/hosts": {
+      "get": {
+        "summary": "List the known hosts",
+        "responses": {"200": {"description": "Hosts sorted by MAC address", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/HostView"}}}}}}
+      },
+      "post": {
+        "summary": "Add a host to the inventory directory",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Host"}}}},
+        "responses": {"201": {"$ref": "#/components/responses/HostView"}, "400": {"$ref": "#/components/responses/Error"}, "409": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/hosts/{mac}": {
+      "parameters": [{"$ref": "#/components/parameters/mac"}],
+      "get": {
+        "summary": "Show a host",
+        "responses": {"200": {"$ref": "#/components/responses/HostView"}, "404": {"$ref": "#/components/responses/Error"}}
+      },
+      "put": {
+        "summary": "Replace a host that has its own file in the inventory directory",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Host"}}}},
+        "responses": {"200": {"$ref": "#/components/responses/HostView"}, "400": {"$ref": "#/components/responses/Error"}, "404": {"$ref": "#/components/responses/Error"}, "409": {"$ref": "#/components/responses/Error"}}
+      },
+      "delete": {
+        "summary": "Remove a host that has its own file in the inventory directory",
+        "responses": {"204": {"description": "Removed"}, "404": {"$ref": "#/components/responses/Error"}, "409": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/hosts/{mac}/reservation": {
+      "parameters": [{"$ref": "#/components/parameters/mac"}],
+      "put": {
+        "summary": "Reserve an address for a host",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"type": "object", "required": ["ip"], "properties": {"ip": {"type": "string", "format": "ipv4"}}}}}},
+        "responses": {"200": {"$ref": "#/components/responses/HostView"}, "400": {"$ref": "#/components/responses/Error"}, "409": {"$ref": "#/components/responses/Error"}}
+      },
+      "delete": {
+        "summary": "Remove the address reservation of a host",
+        "responses": {"200": {"$ref": "#/components/responses/HostView"}, "409": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/hosts/{mac}/state": {
+      "parameters": [{"$ref": "#/components/parameters/mac"}],
+      "get": {
+        "summary": "Show the provisioning state of a host",
+        "responses": {"200": {"$ref": "#/components/responses/HostStatus"}}
+      }
+    },
+    "/hosts/{mac}/rearm": {
+      "parameters": [{"$ref": "#/components/parameters/mac"}],
+      "post": {
+        "summary": "Install the host again on its next boot",
+        "responses": {"200": {"$ref": "#/components/responses/HostStatus"}}
+      }
+    },
+    "/hosts/{mac}/installed": {
+      "parameters": [{"$ref": "#/components/parameters/mac"}],
+      "post": {
+        "summary": "Installer callback: the install finished",
+        "description": "Accepted for hosts of the inventory, and for hosts found by their UUID or serial number once they were handed their boot config, from the leased or reserved address of the host or with one of its install tokens.",
+        "security": [],
+        "parameters": [{"$ref": "#/components/parameters/token"}],
+        "responses": {"200": {"$ref": "#/components/responses/HostStatus"}, "403": {"$ref": "#/components/responses/Error"}, "404": {"$ref": "#/components/responses/Error"}, "409": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/hosts/{mac}/events": {
+      "parameters": [{"$ref": "#/components/parameters/mac"}],
+      "get": {
+        "summary": "List the install events of a host, oldest first",
+        "responses": {"200": {"description": "Events", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/InstallEvent"}}}}}}
+      },
+      "post": {
+        "summary": "Installer callback: report an install event",
+        "description": "The event is sent as JSON, as form values, or as query parameters with the log snippet as the request body. Events are accepted from the same hosts as the installed callback.",
+        "security": [],
+        "parameters": [
+          {"name": "type", "in": "query", "schema": {"type": "string", "enum": ["start", "progress", "success", "failure"]}},
+          {"name": "stage", "in": "query", "schema": {"type": "string"}},
+          {"name": "message", "in": "query", "schema": {"type": "string"}},
+          {"name": "progress", "in": "query", "schema": {"type": "integer", "minimum": 0, "maximum": 100}},
+          {"$ref": "#/components/parameters/token"}
+        ],
+        "requestBody": {"content": {
+          "application/json": {"schema": {"$ref": "#/components/schemas/InstallEvent"}},
+          "application/x-www-form-urlencoded": {"schema": {"$ref": "#/components/schemas/InstallEvent"}},
+          "text/plain": {"schema": {"type": "string", "description": "log snippet"}}
+        }},
+        "responses": {"200": {"$ref": "#/components/responses/HostStatus"}, "400": {"$ref": "#/components/responses/Error"}, "403": {"$ref": "#/components/responses/Error"}, "404": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/reservations": {
+      "get": {
+        "summary": "List the hosts with a reserved address",
+        "responses": {"200": {"description": "Hosts", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Host"}}}}}}
+      }
+    },
+    "/transfers/tftp": {
+      "get": {
+        "summary": "List the active and recent TFTP transfers",
+        "responses": {"200": {"description": "Transfers, recent ones newest first", "content": {"application/json": {"schema": {"type": "object", "properties": {
+          "active": {"type": "array", "items": {"$ref": "#/components/schemas/TFTPTransfer"}},
+          "recent": {"type": "array", "items": {"$ref": "#/components/schemas/TFTPTransfer"}}
+        }}}}}}
+      }
+    },
+    "/transfers/http": {
+      "get": {
+        "summary": "List the active and recent HTTP downloads",
+        "responses": {"200": {"description": "Transfers, recent ones newest first", "content": {"application/json": {"schema": {"type": "object", "properties": {
+          "active": {"type": "array", "items": {"$ref": "#/components/schemas/HTTPTransfer"}},
+          "recent": {"type": "array", "items": {"$ref": "#/components/schemas/HTTPTransfer"}}
+        }}}}}}
+      }
+    },
+    "/templates/render": {
+      "post": {
+        "summary": "Render the templates again",
+        "responses": {"200": {"description": "Rendered"}, "500": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/config": {
+      "get": {
+        "summary": "Show the configuration in use, without the API token",
+        "responses": {"200": {"description": "Configuration laid out like the config file", "content": {"application/json": {"schema": {"type": "object"}}}}}
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "token": {"type": "http", "scheme": "bearer"}
+    },
+    "parameters": {
+      "mac": {"name": "mac", "in": "path", "required": true, "schema": {"type": "string", "example": "52:54:00:12:34:56"}},
+      "token": {"name": "token", "in": "query", "description": "install token of the host, for callbacks from another address than its lease or reservation", "schema": {"type": "string"}}
+    },
+    "responses": {
+      "Error": {"description": "Error", "content": {"application/json": {"schema": {"type": "object", "properties": {"error": {"type": "string"}}}}}},
+      "Lease": {"description": "Lease", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Lease"}}}},
+      "HostView": {"description": "Host", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/HostView"}}}},
+      "HostStatus": {"description": "Provisioning state", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/HostStatus"}}}}
+    },
+    "schemas": {
+      "Lease": {"type": "object", "properties": {
+        "mac_address": {"type": "string"},
+        "ip_address": {"type": "string"},
+        "expires": {"type": "string", "format": "date-time"}
+      }},
+      "Host": {"type": "object", "required": ["mac"], "properties": {
+        "mac": {"type": "string"},
+        "uuid": {"type": "string"},
+        "serial": {"type": "string"},
+        "hostname": {"type": "string"},
+        "ip": {"type": "string", "description": "reserved DHCP address"},
+        "profile": {"type": "string"},
+        "metadata": {"type": "object", "additionalProperties": {"type": "string"}}
+      }},
+      "HostView": {"allOf": [{"$ref": "#/components/schemas/Host"}, {"type": "object", "properties": {
+        "source": {"type": "string", "description": "file the host is defined in"},
+        "status": {"$ref": "#/components/schemas/HostStatus"},
+        "last_event": {"$ref": "#/components/schemas/InstallEvent"},
+        "lease": {"$ref": "#/components/schemas/Lease"}
+      }}]},
+      "HostStatus": {"type": "object", "properties": {
+        "mac": {"type": "string"},
+        "state": {"type": "string", "enum": ["discovered", "installing", "installed", "failed", "localboot"]},
+        "updated": {"type": "string", "format": "date-time"},
+        "installs": {"type": "integer"}
+      }},
+      "InstallEvent": {"type": "object", "required": ["type"], "properties": {
+        "time": {"type": "string", "format": "date-time", "readOnly": true},
+        "type": {"type": "string", "enum": ["start", "progress", "success", "failure"]},
+        "stage": {"type": "string"},
+        "message": {"type": "string"},
+        "progress": {"type": "integer", "minimum": 0, "maximum": 100},
+        "log": {"type": "string"},
+        "client": {"type": "string", "readOnly": true}
+      }},
+      "TFTPTransfer": {"type": "object", "properties": {
+        "id": {"type": "integer"},
+        "client": {"type": "string"},
+        "file": {"type": "string"},
+        "size": {"type": "integer"},
+        "bytes": {"type": "integer"},
+        "options": {"type": "object", "additionalProperties": {"type": "string"}, "description": "options the client negotiated, as far as they show: blksize"},
+        "start": {"type": "string", "format": "date-time"},
+        "end": {"type": "string", "format": "date-time"},
+        "last_progress": {"type": "string", "format": "date-time"},
+        "outcome": {"type": "string", "enum": ["in-progress", "complete", "aborted", "failed"]},
+        "stalled": {"type": "boolean"},
+        "retransmits": {"type": "integer", "description": "packets of the transfer sent again after a timeout"},
+        "error": {"type": "string"}
+      }},
+      "HTTPTransfer": {"type": "object", "properties": {
+        "id": {"type": "integer"},
+        "client": {"type": "string"},
+        "method": {"type": "string"},
+        "path": {"type": "string"},
+        "status": {"type": "integer"},
+        "size": {"type": "integer", "description": "Content-Length, -1 if unknown"},
+        "bytes": {"type": "integer"},
+        "start": {"type": "string", "format": "date-time"},
+        "end": {"type": "string", "format": "date-time"},
+        "outcome": {"type": "string", "enum": ["in-progress", "complete", "aborted", "failed"]},
+        "error": {"type": "string"}
+      }}
+    }
+  }
+}
+`
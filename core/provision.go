@@ -0,0 +1,170 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Provisioning states of a host.
+const (
+	StateDiscovered = "discovered" // seen on the network, will install on next boot
+	StateInstalling = "installing" // installer was served
+	StateInstalled  = "installed"  // installer reported completion
+	StateFailed     = "failed"     // installer reported a failure, will install again on next boot
+	StateLocalBoot  = "localboot"  // booted from local disk since the install
+)
+
+// validTransitions lists the states each state may move to; any state may
+// be re-armed back to discovered. A host installed from the static menus
+// was never handed its own boot config, so it may report being installed
+// without having been installing.
+var validTransitions = map[string][]string{
+	StateDiscovered: {StateInstalling, StateInstalled},
+	StateInstalling: {StateInstalling, StateInstalled, StateFailed},
+	StateFailed:     {StateInstalling, StateInstalled, StateFailed},
+	StateInstalled:  {StateLocalBoot},
+	StateLocalBoot:  {StateLocalBoot},
+}
+
+// HostStatus is the provisioning state of a host.
+type HostStatus struct {
+	MAC      string    `json:"mac"`
+	State    string    `json:"state"`
+	Updated  time.Time `json:"updated"`
+	Installs int       `json:"installs"` // number of completed installs
+}
+
+// provisionTracker keeps the provisioning state of every host seen and
+// saves it to a file on each change.
+type provisionTracker struct {
+	lock     sync.Mutex
+	fileName string
+	states   map[string]*HostStatus
+}
+
+func newProvisionTracker(fileName string) *provisionTracker {
+	return &provisionTracker{
+		fileName: fileName,
+		states:   make(map[string]*HostStatus),
+	}
+}
+
+// load reads the saved states. A missing file is not an error.
+func (p *provisionTracker) load() error {
+	data, err := ioutil.ReadFile(p.fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var states []*HostStatus
+	if err := json.Unmarshal(data, &states); err != nil {
+		return fmt.Errorf("%s: %s", p.fileName, err)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, status := range states {
+		p.states[status.MAC] = status
+	}
+	return nil
+}
+
+// save writes all states; the caller holds the lock.
+func (p *provisionTracker) save() error {
+	states := make([]*HostStatus, 0, len(p.states))
+	for _, status := range p.states {
+		states = append(states, status)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].MAC < states[j].MAC })
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(p.fileName, data, 0644)
+}
+
+// Get returns the state of a host; hosts never seen are discovered.
+func (p *provisionTracker) Get(mac string) HostStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if status, ok := p.states[mac]; ok {
+		return *status
+	}
+	return HostStatus{MAC: mac, State: StateDiscovered}
+}
+
+// All returns the state of every host seen, sorted by MAC address.
+func (p *provisionTracker) All() []HostStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	states := make([]HostStatus, 0, len(p.states))
+	for _, status := range p.states {
+		states = append(states, *status)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].MAC < states[j].MAC })
+	return states
+}
+
+// Seen records a host as discovered the first time it shows up, and
+// reports whether it was new.
+func (p *provisionTracker) Seen(mac string) (bool, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.states[mac]; ok {
+		return false, nil
+	}
+	p.states[mac] = &HostStatus{MAC: mac, State: StateDiscovered, Updated: time.Now()}
+	return true, p.save()
+}
+
+// Advance moves a host to state, if the transition is valid.
+func (p *provisionTracker) Advance(mac, state string) (HostStatus, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	status, ok := p.states[mac]
+	if !ok {
+		status = &HostStatus{MAC: mac, State: StateDiscovered}
+	}
+	allowed := false
+	for _, next := range validTransitions[status.State] {
+		if next == state {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return *status, fmt.Errorf("host %s cannot go from %s to %s", mac, status.State, state)
+	}
+	if state == StateInstalled {
+		status.Installs++
+	}
+	status.State = state
+	status.Updated = time.Now()
+	p.states[mac] = status
+	return *status, p.save()
+}
+
+// Rearm sets a host back to discovered so it installs on its next boot.
+func (p *provisionTracker) Rearm(mac string) (HostStatus, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	status, ok := p.states[mac]
+	if !ok {
+		status = &HostStatus{MAC: mac}
+		p.states[mac] = status
+	}
+	status.State = StateDiscovered
+	status.Updated = time.Now()
+	return *status, p.save()
+}
+
+// installDone reports whether a host in this state should boot from disk.
+func installDone(state string) bool {
+	return state == StateInstalled || state == StateLocalBoot
+}
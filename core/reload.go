@@ -0,0 +1,193 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Reload re-reads the config file, re-renders the templates and applies the
+// result to the running servers without closing their sockets. An invalid
+// config or a template that fails to render is rejected and the current
+// configuration is kept.
+func (s *Service) Reload() error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	s.Logger.Infof("[PXES] reloading configuration from %s", s.ConfigFile)
+	v, err := readConfig(s.ConfigFile)
+	if err != nil {
+		s.Logger.Errorf("[PXES] reload rejected, keeping current configuration: %s", err)
+		return err
+	}
+	next := &Service{ConfigFile: s.ConfigFile, Logger: s.Logger, metrics: s.metrics}
+	if err = next.loadConfig(v); err == nil {
+		err = next.validateConfig()
+	}
+	if err == nil {
+		err = s.checkReservedLeases(next.Hosts)
+	}
+	if err != nil {
+		s.Logger.Errorf("[PXES] reload rejected, keeping current configuration: %s", err)
+		return err
+	}
+	for _, key := range s.restartRequired(next) {
+		s.Logger.Warningf("[PXES] %s changed, restart pxesrv to apply it", key)
+	}
+	next.keepStartupSettings(s)
+	next.inventory = newInventory()
+	next.inventory.load(next.Profiles, next.Hosts)
+	next.isoMounts = s.isoMounts
+	if err = next.LoadAndRenderTemplates(); err != nil {
+		s.Logger.Errorf("[PXES] reload rejected, keeping current configuration: %s", err)
+		return err
+	}
+
+	s.settingsLock.Lock()
+	s.Settings = next.Settings
+	s.settingsLock.Unlock()
+	if levels, err := next.Log.levels(); err == nil && s.logBackend != nil {
+		s.logBackend.setLevels(levels)
+	}
+	s.inventory.load(next.Profiles, next.Hosts)
+	if s.dhcpService != nil {
+		s.dhcpService.updateConfig(s.newDHCPService())
+	}
+	s.Logger.Info("[PXES] configuration reloaded")
+	return nil
+}
+
+// restartRequired lists the settings of next that differ from the running
+// configuration but cannot be changed without rebinding or reopening files.
+func (s *Service) restartRequired(next *Service) []string {
+	settings := []struct {
+		key          string
+		current, new interface{}
+	}{
+		{"global.doc_root", s.DocRoot, next.DocRoot},
+		{"global.log_file_path", s.LogFilePath, next.LogFilePath},
+		{"global.log_file_name", s.LogFileName, next.LogFileName},
+		{"log", []interface{}{s.Log.Format, s.Log.MaxSize, s.Log.RotateEvery, s.Log.MaxBackups, s.Log.MaxAge},
+			[]interface{}{next.Log.Format, next.Log.MaxSize, next.Log.RotateEvery, next.Log.MaxBackups, next.Log.MaxAge}},
+		{"global.watch_config", s.WatchConfig, next.WatchConfig},
+		{"pxe.listen_ip", s.ListenIP, next.ListenIP},
+		{"pxe.http_port", s.HTTPPort, next.HTTPPort},
+		{"pxe.http_root", s.HTTPRoot, next.HTTPRoot},
+		{"pxe.tftp_port", s.TFTPPort, next.TFTPPort},
+		{"pxe.tftp_root", s.TFTPRoot, next.TFTPRoot},
+		{"pxe.dhcp_port", s.DHCPPort, next.DHCPPort},
+		{"pxe.lease_file", s.LeaseFile, next.LeaseFile},
+		{"provision.state_file", s.StateFile, next.StateFile},
+		{"provision.events", []interface{}{s.EventsDir, s.EventsKeep}, []interface{}{next.EventsDir, next.EventsKeep}},
+		{"cache", []interface{}{s.CacheSize, s.CachePreload}, []interface{}{next.CacheSize, next.CachePreload}},
+		{"iso", s.ISOMounts, next.ISOMounts},
+		{"tftp", []interface{}{s.TFTPTimeout, s.TFTPStallTimeout, s.TFTPHistorySize},
+			[]interface{}{next.TFTPTimeout, next.TFTPStallTimeout, next.TFTPHistorySize}},
+		{"http.history_size", s.HTTPHistorySize, next.HTTPHistorySize},
+		{"notify", []interface{}{s.AuditFile, s.Webhooks, s.EventQueueSize},
+			[]interface{}{next.AuditFile, next.Webhooks, next.EventQueueSize}},
+	}
+	var changed []string
+	for _, setting := range settings {
+		if !reflect.DeepEqual(setting.current, setting.new) {
+			changed = append(changed, setting.key)
+		}
+	}
+	return changed
+}
+
+// keepStartupSettings copies the settings that only apply at startup from
+// the running service.
+func (s *Service) keepStartupSettings(running *Service) {
+	s.DocRoot = running.DocRoot
+	s.LogFilePath = running.LogFilePath
+	s.LogFileName = running.LogFileName
+	s.Log.Format = running.Log.Format
+	s.Log.MaxSize = running.Log.MaxSize
+	s.Log.RotateEvery = running.Log.RotateEvery
+	s.Log.MaxBackups = running.Log.MaxBackups
+	s.Log.MaxAge = running.Log.MaxAge
+	s.WatchConfig = running.WatchConfig
+	s.ListenIP = running.ListenIP
+	s.HTTPPort = running.HTTPPort
+	s.HTTPRoot = running.HTTPRoot
+	s.TFTPPort = running.TFTPPort
+	s.TFTPRoot = running.TFTPRoot
+	s.DHCPPort = running.DHCPPort
+	s.LeaseFile = running.LeaseFile
+	s.StateFile = running.StateFile
+	s.EventsDir = running.EventsDir
+	s.EventsKeep = running.EventsKeep
+	s.CacheSize = running.CacheSize
+	s.CachePreload = running.CachePreload
+	s.ISOMounts = running.ISOMounts
+	s.TFTPTimeout = running.TFTPTimeout
+	s.TFTPStallTimeout = running.TFTPStallTimeout
+	s.TFTPHistorySize = running.TFTPHistorySize
+	s.HTTPHistorySize = running.HTTPHistorySize
+	s.AuditFile = running.AuditFile
+	s.Webhooks = running.Webhooks
+	s.EventQueueSize = running.EventQueueSize
+}
+
+// watchConfig reloads the service when the config file or a template
+// changes, until stop is closed. Events are debounced so an editor saving
+// several files triggers a single reload.
+func (s *Service) watchConfig(stop <-chan struct{}) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		s.Logger.Errorf("[PXES] could not watch configuration: %s", err)
+		return
+	}
+	defer watcher.Close()
+
+	configFile, _ := filepath.Abs(s.ConfigFile)
+	// Watch the directory, editors often replace the file instead of writing it.
+	if err := watcher.Add(filepath.Dir(configFile)); err != nil {
+		s.Logger.Errorf("[PXES] could not watch %s: %s", configFile, err)
+		return
+	}
+	templateRoot := filepath.Join(s.DocRoot, templatePath)
+	filepath.Walk(templateRoot, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			watcher.Add(path)
+		}
+		return nil
+	})
+	if inventoryDir := s.settings().InventoryDir; inventoryDir != "" {
+		watcher.Add(inventoryDir)
+	}
+	s.Logger.Infof("[PXES] watching %s and %s for changes", configFile, templateRoot)
+
+	var reload <-chan time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case event := <-watcher.Events:
+			path, _ := filepath.Abs(event.Name)
+			if path != configFile && !isTemplateEvent(templateRoot, event) && filepath.Dir(path) != s.settings().InventoryDir {
+				continue
+			}
+			if event.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					watcher.Add(event.Name)
+				}
+			}
+			reload = time.After(time.Second)
+		case err := <-watcher.Errors:
+			s.Logger.Warningf("[PXES] configuration watch error: %s", err)
+		case <-reload:
+			reload = nil
+			s.Reload()
+		}
+	}
+}
+
+func isTemplateEvent(templateRoot string, event fsnotify.Event) bool {
+	return strings.HasPrefix(filepath.Clean(event.Name), filepath.Clean(templateRoot)+string(filepath.Separator))
+}
@@ -0,0 +1,176 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// loadSecrets reads the secrets the templates use: the name: value pairs
+// of fileName, then every environment variable starting with envPrefix,
+// named by the rest of the variable in lower case, so PXESRV_SECRET_ROOT_PASSWORD
+// sets root_password. The environment overrides the file.
+func loadSecrets(fileName, envPrefix string) (map[string]string, error) {
+	secrets := make(map[string]string)
+	if fileName != "" {
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, fmt.Errorf("secrets.file: %s", err)
+		}
+		if err := yaml.UnmarshalStrict(data, &secrets); err != nil {
+			return nil, fmt.Errorf("%s: %s", fileName, err)
+		}
+	}
+	if envPrefix != "" {
+		for _, env := range os.Environ() {
+			kv := strings.SplitN(env, "=", 2)
+			if len(kv) == 2 && strings.HasPrefix(kv[0], envPrefix) && len(kv[0]) > len(envPrefix) {
+				secrets[strings.ToLower(strings.TrimPrefix(kv[0], envPrefix))] = kv[1]
+			}
+		}
+	}
+	return secrets, nil
+}
+
+// secretNames returns the names of the secrets, sorted; their values are
+// never shown.
+func secretNames(secrets map[string]string) []string {
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Secret returns the secret name, {{.Secret "root_password" | sha512crypt}}.
+// A file rendered with a secret is only served to the host it is rendered
+// for, during its install window.
+func (d *templateData) Secret(name string) (string, error) {
+	value, ok := d.secrets[name]
+	if !ok {
+		return "", fmt.Errorf("secret %q is not set", name)
+	}
+	d.usedSecret = true
+	return value, nil
+}
+
+// HasSecret reports whether the secret name is set, so a template can
+// leave out what it would need it for.
+func (d *templateData) HasSecret(name string) bool {
+	_, ok := d.secrets[name]
+	return ok
+}
+
+// secretDeniedError is a file rendered with a secret requested by a
+// client it is not served to.
+type secretDeniedError struct {
+	file   string
+	reason string
+}
+
+func (e *secretDeniedError) Error() string {
+	return fmt.Sprintf("%s/%s uses secrets: %s", templatePath, e.file, e.reason)
+}
+
+// checkSecretAccess decides whether the file, rendered with a secret for
+// data, may be sent to the client. The client must be the host the file
+// was rendered for, shown by its lease or reservation and, if tokens are
+// enabled, by its install token as well, and the host must be installing,
+// having been handed its boot config less than the install window ago.
+func (s *Service) checkSecretAccess(file string, data *templateData) error {
+	cfg := s.settings()
+	mac := data.Host.MAC
+	if mac == "" {
+		return &secretDeniedError{file, "the client is not a known host"}
+	}
+	status := s.provision.Get(mac)
+	if status.State != StateInstalling {
+		return &secretDeniedError{file, fmt.Sprintf("%s is %s, not installing", mac, status.State)}
+	}
+	if time.Since(status.Updated) > cfg.InstallWindow {
+		return &secretDeniedError{file, fmt.Sprintf("the install window of %s closed at %s", mac,
+			status.Updated.Add(cfg.InstallWindow).Format(time.RFC3339))}
+	}
+	if client := s.addressMAC(data.ClientIP); client != mac {
+		return &secretDeniedError{file, fmt.Sprintf("rendered for %s, requested from %s", mac, data.ClientIP)}
+	}
+	if cfg.SecretTokens && !s.installTokens.valid(data.Query.Get("token"), mac) {
+		return &secretDeniedError{file, fmt.Sprintf("no valid token for %s", mac)}
+	}
+	return nil
+}
+
+// addressMAC returns the MAC address of the host at ip, found by its
+// lease or its reservation.
+func (s *Service) addressMAC(ip string) string {
+	if mac := s.clientMAC(ip); mac != "" {
+		return mac
+	}
+	if parsed := net.ParseIP(ip); parsed != nil {
+		mac, _ := s.inventory.reservedFor(parsed)
+		return mac
+	}
+	return ""
+}
+
+// installToken is a token of a host, added to the URLs of its boot config
+// and good for every file of the install until the install window closes.
+type installToken struct {
+	mac     string
+	expires time.Time
+}
+
+// installTokenStore keeps the tokens handed out with the boot configs of
+// the hosts until they are used or expire.
+type installTokenStore struct {
+	lock   sync.Mutex
+	tokens map[string]installToken
+}
+
+func newInstallTokenStore() *installTokenStore {
+	return &installTokenStore{tokens: make(map[string]installToken)}
+}
+
+// issue returns a new token of the host mac, valid for ttl.
+func (t *installTokenStore) issue(mac string, ttl time.Duration) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	now := time.Now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for key, old := range t.tokens {
+		if now.After(old.expires) {
+			delete(t.tokens, key)
+		}
+	}
+	t.tokens[token] = installToken{mac: mac, expires: now.Add(ttl)}
+	return token, nil
+}
+
+// valid reports whether token is a token of mac that has not expired. It
+// stays valid for the other files of the install and for retries.
+func (t *installTokenStore) valid(token, mac string) bool {
+	if t == nil || token == "" {
+		return false
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	issued, ok := t.tokens[token]
+	if !ok || issued.mac != mac || time.Now().After(issued.expires) {
+		return false
+	}
+	return true
+}
@@ -1,97 +1,491 @@
 package core
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/op/go-logging"
+	"github.com/pin/tftp"
 	"github.com/spf13/viper"
 )
 
+// ErrShutdownTimeout is returned by Start when transfers were still in
+// progress at the end of the shutdown deadline.
+var ErrShutdownTimeout = errors.New("shutdown deadline exceeded")
+
+// Settings are the parts of the configuration a reload replaces. Once the
+// service runs, the goroutines serving clients read them through settings,
+// so they see either the old or the new configuration but never a mix.
+type Settings struct {
+	ServiceIP        string
+	Log              LogConfig // log format, levels and rotation
+	IPRangeStart     string    // dhcp ip range start
+	IPRangeEnd       string    // dhcp ip range end
+	NetMask          string    // dhcp netmask default 255.255.255.0
+	Router           string
+	DNSServer        string
+	TFTPServerName   string
+	PXEBootImage     string // PXE boot file (TFTP)
+	IPXEBootScript   string // iPXE boot script (HTTP)
+	EnableIPXE       bool
+	GrubEFIFile      string             // GRUB boot file (TFTP) of x86-64 UEFI clients, empty gives them PXEBootImage
+	SecureBootClass  string             // DHCP user or vendor class of the clients booting SecureBootFile
+	SecureBootFile   string             // shim boot file (TFTP) of the Secure Boot clients
+	DynamicBoot      bool               // hand iPXE clients the per-host boot script instead of the menu
+	Profiles         map[string]Profile // boot profiles by name
+	Catalog          []CatalogEntry     // operating systems of the boot menus
+	IgnitionBase     string             // Butane template below templates/ignition merged under every Ignition config
+	WindowsShare     string             // SMB share of the HTTP root Windows setup installs from, \\server\share
+	WindowsShareUser string             // user connecting to WindowsShare, with the windows_share_password secret
+	Hosts            []Host             // known hosts, from this file and InventoryDir
+	InventoryDir     string             // directory of host yaml files
+	LocalBoot        string             // how installed hosts boot from disk: auto, exit or sanboot
+	APIToken         string             // bearer token of the management API, empty leaves it open
+	SecretsFile      string             // yaml file of the secrets templates use, name: value
+	SecretsEnvPrefix string             // environment variables with this prefix are secrets too
+	SecretTokens     bool               // add an install token to the kickstart URLs of known hosts
+	InstallWindow    time.Duration      // how long after its boot config a host may fetch files with secrets
+	ShutdownTimeout  time.Duration      // how long shutdown waits for transfers
+	TemplateMode     string             // static or request
+	secrets          map[string]string
+	secretTemplates  map[string]bool // templates rendered with secrets in static mode, rendered on request instead
+}
+
 // A Service represents the state for the All service.
 type Service struct {
 	//Config Config
-	ServiceIP      string
-	DocRoot        string
-	ListenIP       string
-	HTTPPort       string // http listen port default 80
-	HTTPRoot       string // http document root default netboot
-	TFTPPort       string // tftp listen port default 69
-	TFTPRoot       string // tftp document root default netboot
-	DHCPPort       string // dhcp listen port default 67
-	IPRangeStart   string // dhcp ip range start
-	IPRangeEnd     string // dhcp ip range end
-	NetMask        string // dhcp netmask default 255.255.255.0
-	Router         string
-	DNSServer      string
-	TFTPServerName string
-	PXEBootImage   string // PXE boot file (TFTP)
-	IPXEBootScript string // iPXE boot script (HTTP)
-	EnableIPXE     bool
-	errs           chan error
-	Logger         *logging.Logger //default log
+	ConfigFile string
+	Settings
+	DocRoot          string
+	LogFilePath      string
+	LogFileName      string
+	ListenIP         string
+	HTTPPort         string           // http listen port default 80
+	HTTPRoot         string           // http document root default netboot
+	TFTPPort         string           // tftp listen port default 69
+	TFTPRoot         string           // tftp document root default netboot
+	DHCPPort         string           // dhcp listen port default 67
+	StateFile        string           // provisioning state of the hosts
+	EventsDir        string           // install events, one file per host
+	EventsKeep       int              // number of install events kept per host
+	LeaseFile        string           // DHCP leases are saved here on shutdown
+	CacheSize        int64            // boot file cache size in MB, 0 disables caching
+	CachePreload     []string         // files loaded into the cache at startup
+	ISOMounts        []ISOMountConfig // ISO images served without loop mounts
+	TFTPTimeout      time.Duration    // tftp round-trip timeout
+	TFTPStallTimeout time.Duration    // tftp transfers without progress this long are stalled
+	TFTPHistorySize  int              // number of finished tftp transfers kept
+	HTTPHistorySize  int              // number of finished http downloads kept
+	AuditFile        string           // append-only JSON lines file of bus events, empty disables
+	Webhooks         []WebhookConfig  // webhooks the bus events are posted to
+	EventQueueSize   int              // events queued per sink before new ones are dropped
+	WatchConfig      bool             // reload when the config file or templates change
+	Logger           *logging.Logger  //default log
+	inventory        *inventory
+	provision        *provisionTracker
+	installEvents    *installEventLog
+	bus              *eventBus
+	templateCache    *templateCache
+	installTokens    *installTokenStore
+	httpFileSystem   http.FileSystem
+	cache            *fileCache
+	isoMounts        []isoMount
+	tftpTransfers    *tftpTransferLog
+	metrics          *metrics
+	logBackend       *logBackend
+	httpTransfers    *httpTransferLog
+	dhcpService      *DHCPService
+	tftpServer       *tftp.Server
+	httpServer       *http.Server
+	shuttingDown     int32
+	reloadLock       sync.Mutex
+	settingsLock     sync.RWMutex // guards Settings, which Reload replaces
+	hostLock         sync.Mutex   // serializes host changes made through the API
+	errs             chan error
+	done             chan struct{} // closed when the service stops
+}
+
+// settings returns a copy of the current settings.
+func (s *Service) settings() Settings {
+	s.settingsLock.RLock()
+	defer s.settingsLock.RUnlock()
+	return s.Settings
 }
 
 // NewService creates new Service state.
 func NewService() *Service {
 	return &Service{
-		EnableIPXE: true,
-		errs:       make(chan error, 5),
+		Settings:  Settings{EnableIPXE: true},
+		errs:      make(chan error, 5),
+		done:      make(chan struct{}),
+		inventory: newInventory(),
+		metrics:   newMetrics(),
+
+		templateCache: newTemplateCache(),
+		installTokens: newInstallTokenStore(),
 	}
 }
 
 // Initialize the service configuration.
 func (s *Service) Initialize(path string) error {
-	viper.SetConfigType("yaml")
-	viper.SetConfigFile(path)
-	err := viper.ReadInConfig()
+	err := s.LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	s.tftpTransfers = newTFTPTransferLog(s.TFTPHistorySize, s.TFTPTimeout, s.TFTPStallTimeout)
+	s.httpTransfers = newHTTPTransferLog(s.HTTPHistorySize)
+	if err = s.Log.validate(); err != nil {
+		return err
+	}
+	s.Logger, s.logBackend = initLogger(s.LogFilePath, s.LogFileName, s.Log)
+	s.Logger.Info("[PXES] starting pxesrv daemon...")
+	if err = s.validateConfig(); err != nil {
+		s.Logger.Errorf("invalid configuration in %s: %s", path, err)
+		return err
+	}
+	s.inventory.load(s.Profiles, s.Hosts)
+	s.provision = newProvisionTracker(s.StateFile)
+	if err = s.provision.load(); err != nil {
+		s.Logger.Errorf("could not load provisioning state: %s", err)
+		return err
+	}
+	s.installEvents = newInstallEventLog(s.EventsDir, s.EventsKeep)
+	if err = s.installEvents.load(); err != nil {
+		s.Logger.Errorf("could not load install events: %s", err)
+		return err
+	}
+	if err = s.startEventBus(); err != nil {
+		s.Logger.Errorf("could not start the event bus: %s", err)
+		return err
+	}
+	err = s.Prepare()
 	if err != nil {
 		return err
 	}
-	s.ServiceIP = viper.GetString("global.ip_address")
-	var logFilePath string
+	return nil
+}
+
+// LoadConfig reads the config file without preparing or starting anything.
+func (s *Service) LoadConfig(path string) error {
+	s.ConfigFile = path
+	v, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	return s.loadConfig(v)
+}
+
+// readConfig reads a yaml config file into a new viper instance, so a
+// broken file never replaces the configuration in use.
+func readConfig(path string) (*viper.Viper, error) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	v.SetDefault("global.shutdown_timeout", 30)
+	v.SetDefault("global.watch_config", false)
+	v.SetDefault("pxe.lease_file", "leases.json")
+	v.SetDefault("provision.state_file", "hosts.state.json")
+	v.SetDefault("provision.local_boot", "auto")
+	v.SetDefault("provision.events_dir", "events")
+	v.SetDefault("provision.events_keep", 200)
+	v.SetDefault("tftp.timeout", 5)
+	v.SetDefault("tftp.stall_timeout", 10)
+	v.SetDefault("tftp.history_size", 256)
+	v.SetDefault("http.history_size", 256)
+	v.SetDefault("templates.mode", TemplateModeStatic)
+	v.SetDefault("grub.secure_boot_file", "shimx64.efi")
+	v.SetDefault("secrets.env_prefix", "PXESRV_SECRET_")
+	v.SetDefault("secrets.install_window", 120)
+	v.SetDefault("notify.audit_file", "audit.jsonl")
+	v.SetDefault("notify.queue_size", 1024)
+	v.SetDefault("log.format", "text")
+	v.SetDefault("log.level", "info")
+	v.SetDefault("log.max_size", 100)
+	v.SetDefault("log.rotate_every", 0)
+	v.SetDefault("log.max_backups", 7)
+	v.SetDefault("log.max_age", 30)
+	return v, nil
+}
+
+// loadConfig sets the configuration fields from v.
+func (s *Service) loadConfig(v *viper.Viper) error {
+	s.ServiceIP = v.GetString("global.ip_address")
 	if runtime.GOOS == "linux" {
-		s.DocRoot = viper.GetString("global.linux.doc_root")
-		logFilePath = viper.GetString("global.linux.log_file_path")
+		s.DocRoot = v.GetString("global.linux.doc_root")
+		s.LogFilePath = v.GetString("global.linux.log_file_path")
 	} else if runtime.GOOS == "windows" {
-		s.DocRoot = viper.GetString("global.windows.doc_root")
-		logFilePath = viper.GetString("global.windows.log_file_path")
+		s.DocRoot = v.GetString("global.windows.doc_root")
+		s.LogFilePath = v.GetString("global.windows.log_file_path")
 	} else if runtime.GOOS == "darwin" {
-		s.DocRoot = viper.GetString("global.darwin.doc_root")
-		logFilePath = viper.GetString("global.darwin.log_file_path")
-	}
-	s.ListenIP = viper.GetString("pxe.listen_ip")
-	s.HTTPPort = viper.GetString("pxe.http_port")
-	s.HTTPRoot = viper.GetString("pxe.http_root")
-	s.TFTPPort = viper.GetString("pxe.tftp_port")
-	s.TFTPRoot = viper.GetString("pxe.tftp_root")
-	s.DHCPPort = viper.GetString("pxe.dhcp_port")
-	s.IPRangeStart = viper.GetString("pxe.start_ip")
-	s.IPRangeEnd = viper.GetString("pxe.end_ip")
-	s.NetMask = viper.GetString("pxe.netmask")
-	s.Router = viper.GetString("pxe.router")
-	s.DNSServer = viper.GetString("pxe.dns_server")
-	s.TFTPServerName = viper.GetString("global.ip_address")
-	s.PXEBootImage = viper.GetString("pxe.pxe_file")
-	s.IPXEBootScript = viper.GetString("pxe.ipxe_file")
-	s.EnableIPXE = viper.GetBool("pxe.enable_ipxe")
-	logFileName := viper.GetString("global.log_file_name")
-	s.Logger = initLogger(logFilePath, logFileName)
-	s.Logger.Info("[PXES] starting pxesrv daemon...")
-	err = s.Prepare()
+		s.DocRoot = v.GetString("global.darwin.doc_root")
+		s.LogFilePath = v.GetString("global.darwin.log_file_path")
+	}
+	s.LogFileName = v.GetString("global.log_file_name")
+	s.WatchConfig = v.GetBool("global.watch_config")
+	s.TemplateMode = v.GetString("templates.mode")
+	s.Log = LogConfig{
+		Format:      v.GetString("log.format"),
+		Level:       v.GetString("log.level"),
+		Levels:      v.GetStringMapString("log.levels"),
+		MaxSize:     v.GetInt64("log.max_size"),
+		RotateEvery: time.Duration(v.GetInt("log.rotate_every")) * time.Hour,
+		MaxBackups:  v.GetInt("log.max_backups"),
+		MaxAge:      time.Duration(v.GetInt("log.max_age")) * 24 * time.Hour,
+	}
+	s.ListenIP = v.GetString("pxe.listen_ip")
+	s.HTTPPort = v.GetString("pxe.http_port")
+	s.HTTPRoot = v.GetString("pxe.http_root")
+	s.TFTPPort = v.GetString("pxe.tftp_port")
+	s.TFTPRoot = v.GetString("pxe.tftp_root")
+	s.DHCPPort = v.GetString("pxe.dhcp_port")
+	s.IPRangeStart = v.GetString("pxe.start_ip")
+	s.IPRangeEnd = v.GetString("pxe.end_ip")
+	s.NetMask = v.GetString("pxe.netmask")
+	s.Router = v.GetString("pxe.router")
+	s.DNSServer = v.GetString("pxe.dns_server")
+	s.TFTPServerName = v.GetString("global.ip_address")
+	s.PXEBootImage = v.GetString("pxe.pxe_file")
+	s.IPXEBootScript = v.GetString("pxe.ipxe_file")
+	s.EnableIPXE = v.GetBool("pxe.enable_ipxe")
+	s.DynamicBoot = v.GetBool("pxe.dynamic_boot")
+	s.GrubEFIFile = v.GetString("grub.efi_file")
+	s.SecureBootClass = v.GetString("grub.secure_boot_class")
+	s.SecureBootFile = v.GetString("grub.secure_boot_file")
+	s.Profiles = nil
+	if err := v.UnmarshalKey("profiles", &s.Profiles); err != nil {
+		return err
+	}
+	s.Catalog = nil
+	if err := v.UnmarshalKey("catalog", &s.Catalog); err != nil {
+		return err
+	}
+	s.IgnitionBase = v.GetString("ignition.base")
+	s.WindowsShare = v.GetString("windows.share")
+	s.WindowsShareUser = v.GetString("windows.share_user")
+	s.Hosts = nil
+	if err := v.UnmarshalKey("hosts", &s.Hosts); err != nil {
+		return err
+	}
+	s.InventoryDir = v.GetString("inventory.dir")
+	if s.InventoryDir != "" && !filepath.IsAbs(s.InventoryDir) {
+		s.InventoryDir = filepath.Join(s.DocRoot, s.InventoryDir)
+	}
+	hosts, err := loadHostDir(s.InventoryDir)
+	if err != nil {
+		return err
+	}
+	s.Hosts = append(s.Hosts, hosts...)
+	s.CacheSize = v.GetInt64("cache.size")
+	s.CachePreload = v.GetStringSlice("cache.preload")
+	s.ISOMounts = nil
+	if err := v.UnmarshalKey("iso", &s.ISOMounts); err != nil {
+		return err
+	}
+	s.ShutdownTimeout = time.Duration(v.GetInt("global.shutdown_timeout")) * time.Second
+	s.LeaseFile = v.GetString("pxe.lease_file")
+	if !filepath.IsAbs(s.LeaseFile) {
+		s.LeaseFile = filepath.Join(s.DocRoot, s.LeaseFile)
+	}
+	s.StateFile = v.GetString("provision.state_file")
+	if !filepath.IsAbs(s.StateFile) {
+		s.StateFile = filepath.Join(s.DocRoot, s.StateFile)
+	}
+	s.LocalBoot = v.GetString("provision.local_boot")
+	s.EventsDir = v.GetString("provision.events_dir")
+	if !filepath.IsAbs(s.EventsDir) {
+		s.EventsDir = filepath.Join(s.DocRoot, s.EventsDir)
+	}
+	s.EventsKeep = v.GetInt("provision.events_keep")
+	s.TFTPTimeout = time.Duration(v.GetInt("tftp.timeout")) * time.Second
+	s.TFTPStallTimeout = time.Duration(v.GetInt("tftp.stall_timeout")) * time.Second
+	s.TFTPHistorySize = v.GetInt("tftp.history_size")
+	s.HTTPHistorySize = v.GetInt("http.history_size")
+	s.APIToken = v.GetString("api.token")
+	s.SecretsFile = v.GetString("secrets.file")
+	if s.SecretsFile != "" && !filepath.IsAbs(s.SecretsFile) {
+		s.SecretsFile = filepath.Join(s.DocRoot, s.SecretsFile)
+	}
+	s.SecretsEnvPrefix = v.GetString("secrets.env_prefix")
+	s.SecretTokens = v.GetBool("secrets.tokens")
+	s.InstallWindow = time.Duration(v.GetInt("secrets.install_window")) * time.Minute
+	secrets, err := loadSecrets(s.SecretsFile, s.SecretsEnvPrefix)
 	if err != nil {
 		return err
 	}
+	s.secrets = secrets
+	s.AuditFile = v.GetString("notify.audit_file")
+	if s.AuditFile != "" && !filepath.IsAbs(s.AuditFile) {
+		s.AuditFile = filepath.Join(s.DocRoot, s.AuditFile)
+	}
+	s.EventQueueSize = v.GetInt("notify.queue_size")
+	s.Webhooks = nil
+	if err := v.UnmarshalKey("notify.webhooks", &s.Webhooks); err != nil {
+		return err
+	}
+	for i := range s.Webhooks {
+		if s.Webhooks[i].Timeout == 0 {
+			s.Webhooks[i].Timeout = 10
+		}
+		if s.Webhooks[i].Backoff == 0 {
+			s.Webhooks[i].Backoff = 1
+		}
+	}
 	return nil
 }
 
+// validateConfig checks the addresses used by the DHCP server.
+func (s *Service) validateConfig() error {
+	addresses := map[string]string{
+		"global.ip_address": s.ServiceIP,
+		"pxe.start_ip":      s.IPRangeStart,
+		"pxe.end_ip":        s.IPRangeEnd,
+		"pxe.netmask":       s.NetMask,
+	}
+	for key, value := range addresses {
+		if net.ParseIP(value).To4() == nil {
+			return fmt.Errorf("%s: %q is not an IPv4 address", key, value)
+		}
+	}
+	start := binary.BigEndian.Uint32(net.ParseIP(s.IPRangeStart).To4())
+	end := binary.BigEndian.Uint32(net.ParseIP(s.IPRangeEnd).To4())
+	if start >= end {
+		return fmt.Errorf("pxe.start_ip %s must be lower than pxe.end_ip %s", s.IPRangeStart, s.IPRangeEnd)
+	}
+	if s.TemplateMode != TemplateModeStatic && s.TemplateMode != TemplateModeRequest {
+		return fmt.Errorf("templates.mode: %q is not one of static or request", s.TemplateMode)
+	}
+	switch s.LocalBoot {
+	case "auto", "exit", "sanboot":
+	default:
+		return fmt.Errorf("provision.local_boot: %q is not one of auto, exit or sanboot", s.LocalBoot)
+	}
+	if err := s.Log.validate(); err != nil {
+		return err
+	}
+	if s.EventsKeep < 1 {
+		return fmt.Errorf("provision.events_keep: %d must be at least 1", s.EventsKeep)
+	}
+	if s.EventQueueSize < 1 {
+		return fmt.Errorf("notify.queue_size: %d must be at least 1", s.EventQueueSize)
+	}
+	for _, hook := range s.Webhooks {
+		if err := hook.validate(); err != nil {
+			return err
+		}
+	}
+	if s.SecureBootClass != "" && s.SecureBootFile == "" {
+		return fmt.Errorf("grub.secure_boot_file is required with grub.secure_boot_class")
+	}
+	if s.InstallWindow <= 0 {
+		return fmt.Errorf("secrets.install_window: %s must be at least one minute", s.InstallWindow)
+	}
+	if len(s.secrets) > 0 && s.EnableIPXE && !s.DynamicBoot {
+		// The static menu is a plain file; booting from it never moves a
+		// host to installing, so no template could serve it its secrets.
+		return fmt.Errorf("secrets need pxe.dynamic_boot when pxe.enable_ipxe is set: hosts booted from the iPXE menu never get to installing")
+	}
+	if s.WindowsShare != "" && (!strings.HasPrefix(s.WindowsShare, `\\`) || strings.Count(strings.Trim(s.WindowsShare, `\`), `\`) < 1) {
+		return fmt.Errorf(`windows.share: %q is not a \\server\share path`, s.WindowsShare)
+	}
+	if err := validateCatalog(s.Catalog, s.SecretsEnvPrefix); err != nil {
+		return err
+	}
+	if err := newInventory().load(s.Profiles, s.Hosts); err != nil {
+		return err
+	}
+	mask := net.IPMask(net.ParseIP(s.NetMask).To4())
+	subnet := net.IPNet{IP: net.ParseIP(s.ServiceIP).To4().Mask(mask), Mask: mask}
+	for _, host := range s.Hosts {
+		if host.IP != "" && !subnet.Contains(net.ParseIP(host.IP)) {
+			return fmt.Errorf("host %s: ip %s is outside the subnet %s", host.key(), host.IP, subnet.String())
+		}
+	}
+	return nil
+}
+
+// checkReservedLeases rejects hosts whose reserved address is leased to
+// another client. A host known by its UUID or serial number cannot be told
+// from other clients by the MAC address of a lease and is not checked.
+func (s *Service) checkReservedLeases(hosts []Host) error {
+	if s.dhcpService == nil {
+		return nil
+	}
+	for _, host := range hosts {
+		if host.IP == "" || host.MAC == "" {
+			continue
+		}
+		mac, _ := normalizeMAC(host.MAC)
+		if other, ok := s.dhcpService.leasedToOther(net.ParseIP(host.IP), mac); ok {
+			return fmt.Errorf("host %s: ip %s is leased to %s, revoke the lease first", mac, host.IP, other)
+		}
+	}
+	return nil
+}
+
+// RecentTFTPTransfers returns the finished TFTP transfers, newest first.
+func (s *Service) RecentTFTPTransfers() []TFTPTransfer {
+	return s.tftpTransfers.Recent()
+}
+
+// ActiveTFTPTransfers returns the TFTP transfers in progress.
+func (s *Service) ActiveTFTPTransfers() []TFTPTransfer {
+	return s.tftpTransfers.Active()
+}
+
+// RecentHTTPTransfers returns the finished HTTP downloads, newest first.
+func (s *Service) RecentHTTPTransfers() []HTTPTransfer {
+	return s.httpTransfers.Recent()
+}
+
+// ActiveHTTPTransfers returns the HTTP downloads in progress.
+func (s *Service) ActiveHTTPTransfers() []HTTPTransfer {
+	return s.httpTransfers.Active()
+}
+
 // Prepare env
 func (s *Service) Prepare() error {
+	if len(s.ISOMounts) > 0 {
+		mounts, err := loadISOMounts(s.DocRoot, s.ISOMounts)
+		if err != nil {
+			s.Logger.Errorf("error during iso image loading, error: %s", err)
+			return err
+		}
+		s.isoMounts = mounts
+		for _, m := range mounts {
+			s.Logger.Infof("[PXES] serving %s from iso image %s", m.prefix, m.image.name)
+		}
+	}
+	// The menus list the catalog entries whose kernel exists, which may
+	// be in an ISO image.
 	if err := s.LoadAndRenderTemplates(); err != nil {
-		s.Logger.Errorf("error during template rendering, error: %s", err)
 		return err
 	}
+	if s.CacheSize > 0 {
+		s.cache = newFileCache(s.CacheSize << 20)
+		var preload []string
+		for _, name := range s.CachePreload {
+			preload = append(preload, filepath.Join(s.DocRoot, s.TFTPRoot, name))
+		}
+		if err := s.cache.Preload(preload); err != nil {
+			s.Logger.Errorf("error during cache preloading, error: %s", err)
+			return err
+		}
+		usedBytes, count := s.cache.Usage()
+		s.Logger.Infof("[PXES] boot file cache enabled (%d MB), %d files (%d bytes) preloaded", s.CacheSize, count, usedBytes)
+	}
 	return nil
 }
 
@@ -131,15 +525,71 @@ func (s *Service) Start() error {
 
 	//log.debug("Init", "Starting Pixiecore goroutines")
 
+	s.dhcpService = s.newDHCPService()
+	if n, err := s.dhcpService.loadLeases(s.LeaseFile); err != nil {
+		s.Logger.Warningf("[DHCP] could not restore leases from %s: %s", s.LeaseFile, err)
+	} else if n > 0 {
+		s.Logger.Infof("[DHCP] restored %d leases from %s", n, s.LeaseFile)
+	}
+	s.tftpServer = s.newTFTPServer()
+	s.httpServer = s.newHTTPServer()
+
 	go func() { s.errs <- s.serveDHCP(dhcp) }()
 	go func() { s.errs <- s.serveTFTP(tftp) }()
 	go func() { s.errs <- s.serveHTTP(http) }()
+	if s.WatchConfig {
+		go s.watchConfig(s.done)
+	}
 
 	// Wait for either a fatal error, or Shutdown().
 	err = <-s.errs
+	atomic.StoreInt32(&s.shuttingDown, 1)
+	close(s.done)
+	if stopErr := s.stop(dhcp); err == nil {
+		err = stopErr
+	}
+	return err
+}
+
+// stop drains the in-flight TFTP transfers and HTTP downloads within
+// ShutdownTimeout and saves the DHCP leases.
+func (s *Service) stop(dhcp net.PacketConn) error {
+	cfg := s.settings()
+	s.Logger.Infof("[PXES] shutting down, waiting up to %s for transfers to finish", cfg.ShutdownTimeout)
+	var err error
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
 	dhcp.Close()
-	tftp.Close()
-	http.Close()
+
+	if httpErr := s.httpServer.Shutdown(ctx); httpErr != nil {
+		s.Logger.Warningf("[HTTP] downloads still in progress at deadline: %s", httpErr)
+		s.httpServer.Close()
+		err = ErrShutdownTimeout
+	}
+
+	tftpDone := make(chan struct{})
+	go func() {
+		s.tftpServer.Shutdown()
+		close(tftpDone)
+	}()
+	select {
+	case <-tftpDone:
+	case <-ctx.Done():
+		s.Logger.Warningf("[TFTP] %d transfers still in progress at deadline", len(s.ActiveTFTPTransfers()))
+		err = ErrShutdownTimeout
+	}
+
+	if n, leaseErr := s.dhcpService.saveLeases(s.LeaseFile); leaseErr != nil {
+		s.Logger.Errorf("[DHCP] could not save leases to %s: %s", s.LeaseFile, leaseErr)
+		if err == nil {
+			err = leaseErr
+		}
+	} else {
+		s.Logger.Infof("[DHCP] saved %d leases to %s", n, s.LeaseFile)
+	}
+	s.bus.Close(ctx)
+	s.Logger.Info("[PXES] pxesrv daemon stopped")
 	return err
 }
 
@@ -150,3 +600,7 @@ func (s *Service) Shutdown() {
 	default:
 	}
 }
+
+func (s *Service) isShuttingDown() bool {
+	return atomic.LoadInt32(&s.shuttingDown) == 1
+}
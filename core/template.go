@@ -1,20 +1,72 @@
 package core
 
 import (
+	"bytes"
 	"fmt"
-	"html/template"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
 )
 
-var templates map[string]*template.Template
-
 const (
 	templatePath = "templates"
 	targetPath   = "netboot"
 )
 
+// templateData is the data the templates are rendered with. Config holds
+// the whole configuration, laid out like the config file:
+// {{.Config.pxe.router}}, {{index .Config.profiles "centos7"}}.
+type templateData struct {
+	NextServer string // http://<ip_address>:<http_port>
+	ServerIP   string
+	HTTPPort   string
+	TFTPPort   string
+	Netmask    string
+	Router     string
+	DNSServer  string
+	Config     map[string]interface{}
+	Hosts      []Host
+	Profiles   map[string]Profile
+	Catalog    []MenuEntry // enabled catalog entries whose kernel exists
+
+	// Set in request mode only: the client, its host and profile if it is
+	// known, and the query parameters of HTTP requests.
+	ClientIP string
+	MAC      string
+	Host     Host
+	Profile  Profile
+	Query    url.Values
+
+	secrets    map[string]string // read with {{.Secret "name"}}
+	usedSecret bool              // the template read a secret
+}
+
+// newTemplateData returns the data the templates are rendered with.
+func (s *Service) newTemplateData() *templateData {
+	cfg := s.settings()
+	catalog, _ := s.menuEntries()
+	return &templateData{
+		NextServer: fmt.Sprintf("http://%s:%s", cfg.ServiceIP, s.HTTPPort),
+		ServerIP:   cfg.ServiceIP,
+		HTTPPort:   s.HTTPPort,
+		TFTPPort:   s.TFTPPort,
+		Netmask:    cfg.NetMask,
+		Router:     cfg.Router,
+		DNSServer:  cfg.DNSServer,
+		Config:     s.runtimeConfig(),
+		Hosts:      s.inventory.Hosts(),
+		Profiles:   s.inventory.Profiles(),
+		Catalog:    catalog,
+		secrets:    cfg.secrets,
+	}
+}
+
 // PathExists check path exist
 func PathExists(path string) (bool, error) {
 	_, err := os.Stat(path)
@@ -27,50 +79,349 @@ func PathExists(path string) (bool, error) {
 	return false, err
 }
 
-// LoadAndRenderTemplates load tmpl from templates folder
-func (s *Service) LoadAndRenderTemplates() (err error) {
-	if templates == nil {
-		templates = make(map[string]*template.Template)
+// writeFileAtomic writes data to a temporary file next to fileName and
+// renames it into place, so readers never see a partially written file.
+func writeFileAtomic(fileName string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(fileName)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
 	}
-	netxServer := fmt.Sprintf("http://%s:%s", s.ServiceIP, s.HTTPPort)
-	renderData := map[string]string{
-		"NextServer": netxServer,
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(fileName)+".tmp")
+	if err != nil {
+		return err
 	}
-	templateRoot := filepath.Join(s.DocRoot, templatePath)
-	targetRoot := filepath.Join(s.DocRoot, targetPath)
-	exist, _ := PathExists(templateRoot)
-	if !exist {
-		s.Logger.Errorf("template folder %s is not exist", templateRoot)
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
 		return err
 	}
-	filepath.Walk(templateRoot, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() {
-			return nil
-		}
-		if !strings.HasSuffix(path, ".tmpl") {
-			return nil
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), fileName); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// TemplateError is a template that failed to parse or render.
+type TemplateError struct {
+	File string // path of the template below the templates directory
+	Line int    // 0 if unknown
+	Err  string
+}
+
+func (e *TemplateError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s/%s:%d: %s", templatePath, e.File, e.Line, e.Err)
+	}
+	return fmt.Sprintf("%s/%s: %s", templatePath, e.File, e.Err)
+}
+
+// TemplateErrors are the errors of all templates that failed.
+type TemplateErrors []*TemplateError
+
+func (e TemplateErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d template errors: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// templateErrorPosition matches the position text/template puts in front
+// of its errors: "template: linux/ks/x.ks.tmpl:12:3: executing ...".
+var templateErrorPosition = regexp.MustCompile(`^template: (.+?):(\d+)(?::\d+)?: `)
+
+// newTemplateError wraps an error of the template file, taking the file
+// and line out of the text/template message. The file is a shared one if
+// the error is in a block or partial the template uses.
+func newTemplateError(file string, err error) *TemplateError {
+	msg := err.Error()
+	if m := templateErrorPosition.FindStringSubmatch(msg); m != nil && strings.HasSuffix(m[1], ".tmpl") {
+		line, _ := strconv.Atoi(m[2])
+		return &TemplateError{File: m[1], Line: line, Err: msg[len(m[0]):]}
+	}
+	return &TemplateError{File: file, Err: strings.TrimPrefix(msg, "template: ")}
+}
+
+// isSharedTemplate reports whether file is a layout or partial: a
+// template whose name, or the name of a directory it is in, starts with
+// "_", such as _layouts/kickstart.tmpl. Shared templates are loaded into
+// the set of every other template but are not rendered themselves.
+func isSharedTemplate(file string) bool {
+	for _, elem := range strings.Split(file, "/") {
+		if strings.HasPrefix(elem, "_") {
+			return true
 		}
+	}
+	return false
+}
 
-		fileName := filepath.Base(path)
-		templatesFileName := template.Must(template.New(fileName).ParseFiles(path))
+// hostTemplateDirs hold, below the templates directory, the templates of
+// the cloud-init, Ignition and Windows unattend handlers. They are rendered for each host on
+// request, never into netboot, and not served by their own path.
+var hostTemplateDirs = []string{cloudInitTemplateDir, ignitionTemplateDir, windowsTemplateDir}
 
-		destFile := filepath.Join(targetRoot, path[len(templateRoot):])
-		destFile = strings.TrimSuffix(destFile, ".tmpl")
+// isHostTemplate reports whether file is in one of hostTemplateDirs.
+func isHostTemplate(file string) bool {
+	for _, dir := range hostTemplateDirs {
+		if strings.HasPrefix(file, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
 
-		f, err := os.OpenFile(destFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+// walkTemplates calls fn for every .tmpl file below root, in lexical
+// order, with its slash separated path below root.
+func walkTemplates(root string, fn func(file string, info os.FileInfo) error) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			s.Logger.Errorf("error during template rendering In template %s", destFile)
 			return err
 		}
-		defer f.Close()
-
-		err = templatesFileName.Execute(f, renderData)
+		if info.IsDir() || !strings.HasSuffix(path, ".tmpl") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
 		if err != nil {
 			return err
 		}
+		return fn(filepath.ToSlash(rel), info)
+	})
+}
+
+// includeFunc returns the include function of a template set. It renders
+// a named template to a string, so its output can be piped or compared:
+// {{if eq (include "kickstart.release" .) "6"}}.
+func includeFunc(set *template.Template) template.FuncMap {
+	return template.FuncMap{
+		"include": func(name string, data interface{}) (string, error) {
+			var buf bytes.Buffer
+			err := set.ExecuteTemplate(&buf, name, data)
+			return buf.String(), err
+		},
+	}
+}
 
+// addTemplateFile parses the file below root into set, naming it by its
+// path so errors point at the file.
+func addTemplateFile(set *template.Template, root, file string) (*template.Template, error) {
+	data, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(file)))
+	if err != nil {
+		return nil, &TemplateError{File: file, Err: err.Error()}
+	}
+	tmpl, err := set.New(file).Parse(string(data))
+	if err != nil {
+		return nil, newTemplateError(file, err)
+	}
+	return tmpl, nil
+}
+
+// parseSharedTemplates parses the layouts and partials below root into
+// one set, whose env functions refuse the secrets of secretsEnvPrefix.
+// The set is returned along with the errors of the files that failed, so
+// the other templates can still be checked against it.
+func parseSharedTemplates(root, secretsEnvPrefix string) (*template.Template, error) {
+	shared := template.New("").Funcs(templateFuncs(secretsEnvPrefix))
+	shared.Funcs(includeFunc(shared))
+	var errs TemplateErrors
+	err := walkTemplates(root, func(file string, info os.FileInfo) error {
+		if !isSharedTemplate(file) {
+			return nil
+		}
+		if _, err := addTemplateFile(shared, root, file); err != nil {
+			errs = append(errs, err.(*TemplateError))
+		}
 		return nil
 	})
-	s.Logger.Info("[TMPL] templates rendering successful")
+	if err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return shared, errs
+	}
+	return shared, nil
+}
+
+// parseTemplateFile parses the template at file, a slash separated path
+// below root, into a copy of the shared set. Its own {{define}}s override
+// the blocks of the layouts for this template only.
+func parseTemplateFile(shared *template.Template, root, file string) (*template.Template, error) {
+	set, err := shared.Clone()
+	if err != nil {
+		return nil, &TemplateError{File: file, Err: err.Error()}
+	}
+	set.Funcs(includeFunc(set))
+	tmpl, err := addTemplateFile(set, root, file)
+	if err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// parseTemplates parses every .tmpl file below root, except the shared
+// ones, which every template sees. All files are parsed, so that every
+// broken template is reported at once.
+func parseTemplates(root, secretsEnvPrefix string) (map[string]*template.Template, error) {
+	exist, err := PathExists(root)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		return nil, fmt.Errorf("templates directory %s does not exist", root)
+	}
+	var errs TemplateErrors
+	shared, err := parseSharedTemplates(root, secretsEnvPrefix)
+	if sharedErrs, ok := err.(TemplateErrors); ok {
+		errs = append(errs, sharedErrs...)
+	} else if err != nil {
+		return nil, err
+	}
+	parsed := make(map[string]*template.Template)
+	err = walkTemplates(root, func(file string, info os.FileInfo) error {
+		if isSharedTemplate(file) {
+			return nil
+		}
+		tmpl, err := parseTemplateFile(shared, root, file)
+		if err != nil {
+			errs = append(errs, err.(*TemplateError))
+			return nil
+		}
+		parsed[file] = tmpl
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return parsed, nil
+}
+
+// LoadAndRenderTemplates parses every template, renders them into the
+// netboot tree and replaces the rendered files atomically. Nothing is
+// written unless every template parses and renders, so a broken template
+// leaves the previously rendered files in place. In request mode the
+// templates are only parsed, to report errors early.
+func (s *Service) LoadAndRenderTemplates() (err error) {
+	defer func() {
+		if err != nil {
+			s.metrics.templateErrors.Inc()
+			s.logTemplateError(err)
+		}
+	}()
+	templateRoot := filepath.Join(s.DocRoot, templatePath)
+	targetRoot := filepath.Join(s.DocRoot, targetPath)
+	parsed, err := parseTemplates(templateRoot, s.settings().SecretsEnvPrefix)
+	if err != nil {
+		return err
+	}
+	if s.settings().TemplateMode == TemplateModeRequest {
+		s.setSecretTemplates(nil)
+		s.Logger.Infof("[TMPL] %d templates in %s are rendered on request", len(parsed), templateRoot)
+		return nil
+	}
+
+	rendered, secret, err := s.renderTemplates(parsed)
+	if err != nil {
+		return err
+	}
+	// A file with secrets must not be served to anyone from netboot; it is
+	// rendered for each host that requests it, like in request mode.
+	secretTemplates := make(map[string]bool, len(secret))
+	for _, file := range secret {
+		secretTemplates[file] = true
+		destFile := filepath.Join(targetRoot, filepath.FromSlash(strings.TrimSuffix(file, ".tmpl")))
+		if err := os.Remove(destFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removing %s: %s", destFile, err)
+		}
+		s.Logger.Infof("[TMPL] %s uses secrets, it is rendered on request for the host fetching it", file)
+	}
+	s.setSecretTemplates(secretTemplates)
+	_, hidden := s.menuEntries()
+	for _, reason := range hidden {
+		s.Logger.Infof("[TMPL] catalog entry %s, hidden from the boot menus", reason)
+	}
+	files := make([]string, 0, len(rendered))
+	for file := range rendered {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		destFile := filepath.Join(targetRoot, filepath.FromSlash(strings.TrimSuffix(file, ".tmpl")))
+		if err := writeFileAtomic(destFile, rendered[file], 0644); err != nil {
+			return fmt.Errorf("writing %s: %s", destFile, err)
+		}
+	}
+	s.Logger.Infof("[TMPL] rendered %d templates into %s", len(files), targetRoot)
 	return nil
 }
+
+// setSecretTemplates replaces the templates rendered on request because
+// they use secrets.
+func (s *Service) setSecretTemplates(files map[string]bool) {
+	s.settingsLock.Lock()
+	s.secretTemplates = files
+	s.settingsLock.Unlock()
+}
+
+// renderTemplates renders the parsed templates in memory, by file name.
+// The templates that read a secret are left out and listed in secret.
+func (s *Service) renderTemplates(parsed map[string]*template.Template) (rendered map[string][]byte, secret []string, err error) {
+	files := make([]string, 0, len(parsed))
+	for file := range parsed {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	data := s.newTemplateData()
+	rendered = make(map[string][]byte, len(files))
+	var errs TemplateErrors
+	// An error in a layout fails every template using it; it is reported once.
+	seen := make(map[TemplateError]bool)
+	for _, file := range files {
+		if isHostTemplate(file) {
+			// Rendered for each host on request; parsing checked them.
+			continue
+		}
+		var buf bytes.Buffer
+		data.usedSecret = false
+		if err := parsed[file].Execute(&buf, data); err != nil {
+			if e := newTemplateError(file, err); !seen[*e] {
+				seen[*e] = true
+				errs = append(errs, e)
+			}
+			continue
+		}
+		if data.usedSecret {
+			secret = append(secret, file)
+			continue
+		}
+		rendered[file] = buf.Bytes()
+	}
+	if len(errs) > 0 {
+		return nil, nil, errs
+	}
+	return rendered, secret, nil
+}
+
+// logTemplateError logs each template error on its own line.
+func (s *Service) logTemplateError(err error) {
+	if errs, ok := err.(TemplateErrors); ok {
+		for _, e := range errs {
+			s.Logger.Errorf("[TMPL] %s", e)
+		}
+		return
+	}
+	s.Logger.Errorf("[TMPL] %s", err)
+}
@@ -0,0 +1,407 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// templateFuncs returns the functions available to the templates and to
+// profile cmdlines. Names and argument order follow sprig, so the piped
+// value comes last: {{.Host.Metadata.disk | default "sda"}}.
+//
+//	default, empty, coalesce, ternary        defaults and conditions
+//	join, split, list, dict, hasKey          lists and maps
+//	trim, upper, lower, replace, contains,
+//	hasPrefix, hasSuffix, quote, squote,
+//	indent, nindent, toJson                  strings
+//	env, expandenv                           environment, except secrets
+//	b64enc, b64dec                           base64
+//	sha1sum, sha256sum, sha512sum            hex digests
+//	sha512crypt                              crypt(3) $6$ password hash
+//	ipAdd, cidrHost, cidrNetmask,
+//	cidrContains                             IPv4/IPv6 address math
+//	grubPath                                 URL as a GRUB file name
+//	windowsPassword                          password of an unattend file
+//	xml                                      XML text or attribute value
+//
+// Template files also have include, see includeFunc. env and expandenv
+// refuse the variables starting with secretsEnvPrefix: secrets are read
+// with .Secret, which keeps the file from anyone but its host.
+func templateFuncs(secretsEnvPrefix string) template.FuncMap {
+	return template.FuncMap{
+		"default":  defaultValue,
+		"empty":    empty,
+		"coalesce": coalesce,
+		"ternary": func(yes, no interface{}, cond bool) interface{} {
+			if cond {
+				return yes
+			}
+			return no
+		},
+		"join":  join,
+		"split": func(sep, s string) []string { return strings.Split(s, sep) },
+		"list":  func(v ...interface{}) []interface{} { return v },
+		"dict":  dict,
+		"hasKey": func(m map[string]interface{}, key string) bool {
+			_, ok := m[key]
+			return ok
+		},
+		"trim":      strings.TrimSpace,
+		"upper":     strings.ToUpper,
+		"lower":     strings.ToLower,
+		"replace":   func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+		"contains":  func(substr, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix": func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix": func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"quote":     func(v interface{}) string { return strconv.Quote(fmt.Sprint(v)) },
+		"squote":    func(v interface{}) string { return "'" + fmt.Sprint(v) + "'" },
+		"indent":    indent,
+		"nindent":   func(n int, s string) string { return "\n" + indent(n, s) },
+		"toJson":    toJSON,
+		"env":       envFunc(secretsEnvPrefix),
+		"expandenv": expandenvFunc(secretsEnvPrefix),
+		"b64enc":    func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"b64dec":    b64dec,
+		"sha1sum": func(s string) string {
+			sum := sha1.Sum([]byte(s))
+			return hex.EncodeToString(sum[:])
+		},
+		"sha256sum": func(s string) string {
+			sum := sha256.Sum256([]byte(s))
+			return hex.EncodeToString(sum[:])
+		},
+		"sha512sum": func(s string) string {
+			sum := sha512.Sum512([]byte(s))
+			return hex.EncodeToString(sum[:])
+		},
+		"sha512crypt":     sha512cryptFunc,
+		"ipAdd":           ipAdd,
+		"cidrHost":        cidrHost,
+		"cidrNetmask":     cidrNetmask,
+		"cidrContains":    cidrContains,
+		"grubPath":        grubPath,
+		"windowsPassword": windowsPassword,
+		"xml":             xmlEscape,
+	}
+}
+
+// envFunc returns the env function, which reads an environment variable
+// other than a secret.
+func envFunc(secretsEnvPrefix string) func(string) (string, error) {
+	return func(name string) (string, error) {
+		if isSecretEnv(name, secretsEnvPrefix) {
+			return "", fmt.Errorf("env %s: read secrets with .Secret", name)
+		}
+		return os.Getenv(name), nil
+	}
+}
+
+// expandenvFunc returns the expandenv function, which replaces $var and
+// ${var} in a string as env reads them.
+func expandenvFunc(secretsEnvPrefix string) func(string) (string, error) {
+	return func(s string) (string, error) {
+		var err error
+		expanded := os.Expand(s, func(name string) string {
+			if isSecretEnv(name, secretsEnvPrefix) {
+				if err == nil {
+					err = fmt.Errorf("expandenv %s: read secrets with .Secret", name)
+				}
+				return ""
+			}
+			return os.Getenv(name)
+		})
+		return expanded, err
+	}
+}
+
+// isSecretEnv reports whether the environment variable name is a secret,
+// see loadSecrets.
+func isSecretEnv(name, secretsEnvPrefix string) bool {
+	return secretsEnvPrefix != "" && strings.HasPrefix(name, secretsEnvPrefix)
+}
+
+// empty reports whether v is the zero value of its type, or an empty
+// string, slice or map.
+func empty(v interface{}) bool {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return true
+	}
+	switch rv.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return rv.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return rv.IsNil()
+	}
+	return reflect.DeepEqual(v, reflect.Zero(rv.Type()).Interface())
+}
+
+// defaultValue returns v, or def if v is empty.
+func defaultValue(def interface{}, v ...interface{}) interface{} {
+	if len(v) == 0 || empty(v[0]) {
+		return def
+	}
+	return v[0]
+}
+
+func coalesce(v ...interface{}) interface{} {
+	for _, value := range v {
+		if !empty(value) {
+			return value
+		}
+	}
+	return nil
+}
+
+// join joins the elements of a slice of any type.
+func join(sep string, v interface{}) (string, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return "", fmt.Errorf("join: %T is not a list", v)
+	}
+	parts := make([]string, rv.Len())
+	for i := range parts {
+		parts[i] = fmt.Sprint(rv.Index(i).Interface())
+	}
+	return strings.Join(parts, sep), nil
+}
+
+func dict(v ...interface{}) (map[string]interface{}, error) {
+	if len(v)%2 != 0 {
+		return nil, fmt.Errorf("dict: odd number of arguments")
+	}
+	m := make(map[string]interface{}, len(v)/2)
+	for i := 0; i < len(v); i += 2 {
+		m[fmt.Sprint(v[i])] = v[i+1]
+	}
+	return m, nil
+}
+
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.Replace(s, "\n", "\n"+pad, -1)
+}
+
+func toJSON(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+func b64dec(s string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", fmt.Errorf("b64dec: %s", err)
+	}
+	return string(data), nil
+}
+
+// ipAdd returns the address n addresses after ip; n may be negative.
+func ipAdd(ip string, n int) (string, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return "", fmt.Errorf("ipAdd: %q is not an IP address", ip)
+	}
+	return offsetIP(addr, int64(n))
+}
+
+// cidrHost returns the nth address of a network, counted from the
+// network address; a negative n counts back from the broadcast address.
+func cidrHost(cidr string, n int) (string, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", fmt.Errorf("cidrHost: %s", err)
+	}
+	ones, bits := network.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	offset := big.NewInt(int64(n))
+	if n < 0 {
+		offset.Add(offset, size)
+	}
+	if offset.Sign() < 0 || offset.Cmp(size) >= 0 {
+		return "", fmt.Errorf("cidrHost: %s has no host %d", cidr, n)
+	}
+	return offsetIP(network.IP, offset.Int64())
+}
+
+// offsetIP adds n to the address, keeping IPv4 addresses in 4 bytes.
+func offsetIP(ip net.IP, n int64) (string, error) {
+	if v4 := ip.To4(); v4 != nil {
+		sum := int64(binary.BigEndian.Uint32(v4)) + n
+		if sum < 0 || sum > 0xffffffff {
+			return "", fmt.Errorf("%s + %d is out of the IPv4 range", ip, n)
+		}
+		out := make(net.IP, 4)
+		binary.BigEndian.PutUint32(out, uint32(sum))
+		return out.String(), nil
+	}
+	sum := new(big.Int).Add(new(big.Int).SetBytes(ip.To16()), big.NewInt(n))
+	if sum.Sign() < 0 || sum.BitLen() > 128 {
+		return "", fmt.Errorf("%s + %d is out of the IPv6 range", ip, n)
+	}
+	out := make(net.IP, 16)
+	b := sum.Bytes()
+	copy(out[16-len(b):], b)
+	return out.String(), nil
+}
+
+// cidrNetmask returns the dotted netmask of an IPv4 network.
+func cidrNetmask(cidr string) (string, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", fmt.Errorf("cidrNetmask: %s", err)
+	}
+	if len(network.Mask) != net.IPv4len {
+		return "", fmt.Errorf("cidrNetmask: %s is not an IPv4 network", cidr)
+	}
+	return net.IP(network.Mask).String(), nil
+}
+
+func cidrContains(cidr, ip string) (bool, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false, fmt.Errorf("cidrContains: %s", err)
+	}
+	return network.Contains(net.ParseIP(ip)), nil
+}
+
+// sha512cryptFunc hashes a password for /etc/shadow, kickstart rootpw
+// --iscrypted or preseed passwd/root-password-crypted. A random salt is
+// used unless one is given.
+func sha512cryptFunc(password string, salt ...string) (string, error) {
+	s := ""
+	if len(salt) > 0 {
+		s = salt[0]
+	} else {
+		var err error
+		if s, err = randomSalt(16); err != nil {
+			return "", err
+		}
+	}
+	return sha512Crypt(password, s, sha512CryptRounds), nil
+}
+
+const (
+	cryptAlphabet     = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	sha512CryptRounds = 5000
+)
+
+func randomSalt(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = cryptAlphabet[int(b[i])%len(cryptAlphabet)]
+	}
+	return string(b), nil
+}
+
+// sha512Crypt implements the SHA-512 based crypt(3) of glibc, "$6$".
+func sha512Crypt(password, salt string, rounds int) string {
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	p, s := []byte(password), []byte(salt)
+
+	b := sha512.New()
+	b.Write(p)
+	b.Write(s)
+	b.Write(p)
+	sumB := b.Sum(nil)
+
+	a := sha512.New()
+	a.Write(p)
+	a.Write(s)
+	n := len(p)
+	for ; n > 64; n -= 64 {
+		a.Write(sumB)
+	}
+	a.Write(sumB[:n])
+	for n = len(p); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			a.Write(sumB)
+		} else {
+			a.Write(p)
+		}
+	}
+	sumA := a.Sum(nil)
+
+	dp := sha512.New()
+	for i := 0; i < len(p); i++ {
+		dp.Write(p)
+	}
+	pSeq := repeatBytes(dp.Sum(nil), len(p))
+
+	ds := sha512.New()
+	for i := 0; i < 16+int(sumA[0]); i++ {
+		ds.Write(s)
+	}
+	sSeq := repeatBytes(ds.Sum(nil), len(s))
+
+	sum := sumA
+	for i := 0; i < rounds; i++ {
+		c := sha512.New()
+		if i&1 != 0 {
+			c.Write(pSeq)
+		} else {
+			c.Write(sum)
+		}
+		if i%3 != 0 {
+			c.Write(sSeq)
+		}
+		if i%7 != 0 {
+			c.Write(pSeq)
+		}
+		if i&1 != 0 {
+			c.Write(sum)
+		} else {
+			c.Write(pSeq)
+		}
+		sum = c.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString("$6$")
+	if rounds != sha512CryptRounds {
+		fmt.Fprintf(&out, "rounds=%d$", rounds)
+	}
+	out.WriteString(salt)
+	out.WriteByte('$')
+	for i := 0; i < 21; i++ {
+		idx := [3]int{i, i + 21, i + 42}
+		r := i % 3
+		encodeCrypt24(&out, sum[idx[r]], sum[idx[(r+1)%3]], sum[idx[(r+2)%3]], 4)
+	}
+	encodeCrypt24(&out, 0, 0, sum[63], 2)
+	return out.String()
+}
+
+func repeatBytes(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out)+len(b) <= n {
+		out = append(out, b...)
+	}
+	return append(out, b[:n-len(out)]...)
+}
+
+func encodeCrypt24(out *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		out.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
@@ -0,0 +1,85 @@
+package core
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// The reference vectors of the SHA-crypt specification, also used by the
+// glibc tests.
+func TestSHA512Crypt(t *testing.T) {
+	for _, test := range []struct {
+		password, salt string
+		rounds         int
+		want           string
+	}{
+		{"Hello world!", "saltstring", 5000,
+			"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"Hello world!", "saltstringsaltstring", 10000,
+			"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+		// glibc writes rounds=5000 when the salt asks for it; the hash is
+		// the same.
+		{"This is just a test", "toolongsaltstring", 5000,
+			"$6$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+		{"a very much longer text to encrypt.  This one even stretches over morethan one line.", "anotherlongsaltstring", 1400,
+			"$6$rounds=1400$anotherlongsalts$POfYwTEok97VWcjxIiSOjiykti.o/pQs.wPvMxQ6Fm7I6IoYN3CmLs66x9t0oSwbtEW7o7UmJEiDwGqd8p4ur1"},
+		{"we have a short salt string but not a short password", "short", 77777,
+			"$6$rounds=77777$short$WuQyW2YR.hBNpjjRhpYD/ifIw05xdfeEyQoMxIXbkvr0gge1a1x3yRULJ5CCaUeOxFmtlcGZelFl5CxtgfiAc0"},
+		{"a short string", "asaltof16chars..", 123456,
+			"$6$rounds=123456$asaltof16chars..$BtCwjqMJGx5hrJhZywWvt0RLE8uZ4oPwcelCjmw2kSYu.Ec6ycULevoBK25fs2xXgMNrCzIMVcgEJAstJeonj1"},
+	} {
+		if got := sha512Crypt(test.password, test.salt, test.rounds); got != test.want {
+			t.Errorf("sha512Crypt(%q, %q, %d) = %s, want %s", test.password, test.salt, test.rounds, got, test.want)
+		}
+	}
+}
+
+func TestSHA512CryptFunc(t *testing.T) {
+	got, err := sha512cryptFunc("Hello world!", "saltstring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"; got != want {
+		t.Errorf("sha512crypt with a salt = %s, want %s", got, want)
+	}
+	a, err := sha512cryptFunc("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := sha512cryptFunc("secret")
+	fields := strings.Split(a, "$")
+	if len(fields) != 4 || fields[1] != "6" || len(fields[2]) != 16 || len(fields[3]) != 86 {
+		t.Errorf("sha512crypt without a salt = %s, want $6$<16 character salt>$<86 character hash>", a)
+	}
+	if a == b {
+		t.Errorf("sha512crypt without a salt gave %s twice", a)
+	}
+}
+
+func TestEnvRefusesSecrets(t *testing.T) {
+	os.Setenv("PXESRV_SECRET_ROOT_PASSWORD", "s3cret")
+	os.Setenv("PXESRV_TEST_PROXY", "http://proxy:3128")
+	defer os.Unsetenv("PXESRV_SECRET_ROOT_PASSWORD")
+	defer os.Unsetenv("PXESRV_TEST_PROXY")
+	env := envFunc("PXESRV_SECRET_")
+	if got, err := env("PXESRV_TEST_PROXY"); err != nil || got != "http://proxy:3128" {
+		t.Errorf(`env "PXESRV_TEST_PROXY" = %q, %v`, got, err)
+	}
+	if got, err := env("PXESRV_SECRET_ROOT_PASSWORD"); err == nil || got != "" {
+		t.Errorf(`env "PXESRV_SECRET_ROOT_PASSWORD" = %q, want an error`, got)
+	}
+	expandenv := expandenvFunc("PXESRV_SECRET_")
+	if got, err := expandenv("proxy=$PXESRV_TEST_PROXY"); err != nil || got != "proxy=http://proxy:3128" {
+		t.Errorf("expandenv of the proxy = %q, %v", got, err)
+	}
+	if got, err := expandenv("pw=${PXESRV_SECRET_ROOT_PASSWORD}"); err == nil || strings.Contains(got, "s3cret") {
+		t.Errorf("expandenv of the secret = %q, want an error", got)
+	}
+}
+
+func TestXMLEscape(t *testing.T) {
+	if got, want := xmlEscape(`p&ss<w>rd"'`), "p&amp;ss&lt;w&gt;rd&#34;&#39;"; got != want {
+		t.Errorf("xml = %s, want %s", got, want)
+	}
+}
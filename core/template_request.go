@@ -0,0 +1,233 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Template modes: static renders every template into netboot at startup
+// and on reload, request renders a template when its output is requested.
+const (
+	TemplateModeStatic  = "static"
+	TemplateModeRequest = "request"
+)
+
+// templateCache keeps parsed templates until their file, or one of the
+// shared templates, changes.
+type templateCache struct {
+	lock    sync.Mutex
+	shared  string // stamp of the shared templates the entries were parsed with
+	prefix  string // secrets.env_prefix the entries were parsed with
+	entries map[string]cachedTemplate
+}
+
+type cachedTemplate struct {
+	modTime time.Time
+	size    int64
+	tmpl    *template.Template
+}
+
+func newTemplateCache() *templateCache {
+	return &templateCache{entries: make(map[string]cachedTemplate)}
+}
+
+// get returns the parsed template of file, a slash separated path below
+// root, parsing it again if its modification time or size changed. It
+// returns an os.IsNotExist error if there is no such template; shared
+// templates are not rendered, so they do not exist either. A change of
+// secretsEnvPrefix, which the env functions refuse, parses them again.
+func (c *templateCache) get(root, file, secretsEnvPrefix string) (*template.Template, error) {
+	fileName := filepath.Join(root, filepath.FromSlash(file))
+	if isSharedTemplate(file) {
+		return nil, &os.PathError{Op: "open", Path: fileName, Err: os.ErrNotExist}
+	}
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: fileName, Err: os.ErrNotExist}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	stamp, err := sharedTemplatesStamp(root)
+	if err != nil {
+		return nil, err
+	}
+	if stamp != c.shared || secretsEnvPrefix != c.prefix {
+		c.shared, c.prefix = stamp, secretsEnvPrefix
+		c.entries = make(map[string]cachedTemplate)
+	}
+	entry, ok := c.entries[fileName]
+	if ok && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+		return entry.tmpl, nil
+	}
+	delete(c.entries, fileName)
+	shared, err := parseSharedTemplates(root, secretsEnvPrefix)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := parseTemplateFile(shared, root, file)
+	if err != nil {
+		return nil, err
+	}
+	c.entries[fileName] = cachedTemplate{modTime: info.ModTime(), size: info.Size(), tmpl: tmpl}
+	return tmpl, nil
+}
+
+// sharedTemplatesStamp identifies the current version of the shared
+// templates below root by their names, modification times and sizes.
+func sharedTemplatesStamp(root string) (string, error) {
+	var stamp strings.Builder
+	err := walkTemplates(root, func(file string, info os.FileInfo) error {
+		if isSharedTemplate(file) {
+			fmt.Fprintf(&stamp, "%s %d %d\n", file, info.ModTime().UnixNano(), info.Size())
+		}
+		return nil
+	})
+	return stamp.String(), err
+}
+
+// requestTemplate returns the template rendering the file name, a path
+// below the HTTP or TFTP root, in request mode. In static mode only the
+// templates using secrets are rendered on request.
+func (s *Service) requestTemplate(name string) string {
+	cfg := s.settings()
+	name = path.Clean("/" + filepath.ToSlash(name))
+	if name == "/" {
+		return ""
+	}
+	file := name[1:] + ".tmpl"
+	if isHostTemplate(file) {
+		return ""
+	}
+	if cfg.TemplateMode != TemplateModeRequest && !cfg.secretTemplates[file] {
+		return ""
+	}
+	return file
+}
+
+// renderRequest renders the template of the file name for the client at
+// addr. ok is false if there is no such template.
+func (s *Service) renderRequest(name, addr string, query url.Values) (data []byte, ok bool, err error) {
+	file := s.requestTemplate(name)
+	if file == "" {
+		return nil, false, nil
+	}
+	return s.renderTemplateFor(file, s.newRequestTemplateData(addr, query))
+}
+
+// renderTemplateFor renders the template file, a path below the templates
+// directory, with the request data of a client. ok is false if there is no
+// such template. A file using secrets is only returned if the client may
+// have it.
+func (s *Service) renderTemplateFor(file string, data *templateData) (out []byte, ok bool, err error) {
+	out, ok, err = s.executeTemplateFor(file, data)
+	if !ok || err != nil {
+		return nil, ok, err
+	}
+	if err := s.allowSecrets(file, data); err != nil {
+		return nil, true, err
+	}
+	return out, true, nil
+}
+
+// executeTemplateFor renders the template file with the request data of a
+// client, without checking whether the client may have its secrets.
+func (s *Service) executeTemplateFor(file string, data *templateData) (out []byte, ok bool, err error) {
+	tmpl, err := s.templateCache.get(filepath.Join(s.DocRoot, templatePath), file, s.settings().SecretsEnvPrefix)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err == nil {
+		var buf bytes.Buffer
+		if err = tmpl.Execute(&buf, data); err == nil {
+			return buf.Bytes(), true, nil
+		}
+		err = newTemplateError(file, err)
+	}
+	s.metrics.templateErrors.Inc()
+	s.Logger.Errorf("[TMPL] %s", err)
+	return nil, true, err
+}
+
+// allowSecrets checks, if the template file read a secret while rendering
+// data, that the client may have it.
+func (s *Service) allowSecrets(file string, data *templateData) error {
+	if !data.usedSecret {
+		return nil
+	}
+	if err := s.checkSecretAccess(file, data); err != nil {
+		s.Logger.Warning(withFields(Fields{"mac": data.Host.MAC, "client": data.ClientIP}, "[TMPL] %s", err))
+		return err
+	}
+	s.Logger.Info(withFields(Fields{"mac": data.Host.MAC, "client": data.ClientIP},
+		"[TMPL] %s/%s with secrets served to %s", templatePath, file, data.Host.MAC))
+	return nil
+}
+
+// newRequestTemplateData adds the client to the template data. The host
+// is found from the mac, uuid or serial query parameters, or else from
+// the client address by its lease or reservation.
+func (s *Service) newRequestTemplateData(addr string, query url.Values) *templateData {
+	data := s.newTemplateData()
+	data.ClientIP = addr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		data.ClientIP = host
+	}
+	data.Query = query
+	if data.Query == nil {
+		data.Query = url.Values{}
+	}
+	mac, _ := normalizeMAC(query.Get("mac"))
+	if mac == "" {
+		mac = s.addressMAC(data.ClientIP)
+	}
+	data.MAC = mac
+	if host, profile, ok := s.inventory.find(mac, query.Get("uuid"), query.Get("serial")); ok {
+		data.Host = *host
+		data.MAC = host.MAC
+		if profile != nil {
+			data.Profile = *profile
+		}
+	}
+	return data
+}
+
+// templateHandler serves the files rendered from templates in request
+// mode and passes other requests to next.
+func (s *Service) templateHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		data, ok, err := s.renderRequest(r.URL.Path, r.RemoteAddr, r.URL.Query())
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, denied := err.(*secretDeniedError); denied {
+			// The reason is logged, not told to the client.
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// The output depends on the client, so it carries no Last-Modified.
+		w.Header().Set("Cache-Control", "no-store")
+		http.ServeContent(w, r, path.Base(r.URL.Path), time.Time{}, bytes.NewReader(data))
+	})
+}
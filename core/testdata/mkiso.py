@@ -0,0 +1,102 @@
+#!/usr/bin/env python3
+"""Writes the ISO9660 images iso9660_test.go reads: rockridge.iso with
+Rock Ridge and Joliet names, and joliet.iso with Joliet names only. Both
+hold README.txt and isolinux/vmlinuz."""
+
+import struct
+
+SECTOR = 2048
+DATE = bytes([124, 1, 2, 3, 4, 5, 0])  # 2024-01-02 03:04:05 UTC
+
+
+def both16(n):
+    return struct.pack("<H", n) + struct.pack(">H", n)
+
+
+def both32(n):
+    return struct.pack("<I", n) + struct.pack(">I", n)
+
+
+def record(lba, size, isdir, name, system_use=b""):
+    pad = b"\0" if len(name) % 2 == 0 else b""
+    body = (b"\0" + both32(lba) + both32(size) + DATE + bytes([2 if isdir else 0, 0, 0])
+            + both16(1) + bytes([len(name)]) + name + pad + system_use)
+    if (len(body) + 1) % 2:
+        body += b"\0"
+    return bytes([len(body) + 1]) + body
+
+
+def nm(name):
+    return b"NM" + bytes([5 + len(name), 1, 0]) + name
+
+
+SP = b"SP" + bytes([7, 1, 0xBE, 0xEF, 0])
+
+
+def directory(records):
+    data = b"".join(records)
+    return data + b"\0" * (SECTOR - len(data))
+
+
+def descriptor(kind, root, escape=b""):
+    d = bytearray(SECTOR)
+    d[0] = kind
+    d[1:7] = b"CD001\x01"
+    d[40:46] = b"PXESRV"
+    d[80:88] = both32(TOTAL)
+    d[88:88 + len(escape)] = escape
+    d[120:124] = both16(1)
+    d[124:128] = both16(1)
+    d[128:132] = both16(SECTOR)
+    d[156:190] = root
+    d[881] = 1
+    return bytes(d)
+
+
+ROOT, ISOLINUX, JROOT, JISOLINUX, VMLINUZ, README, TOTAL = 19, 20, 21, 22, 23, 24, 25
+KERNEL = b"kernel image\n"
+TEXT = b"pxesrv test image\n"
+
+
+def image(rock_ridge):
+    def su(*entries):
+        return b"".join(entries) if rock_ridge else b""
+
+    root = directory([
+        record(ROOT, SECTOR, True, b"\0", su(SP)),
+        record(ROOT, SECTOR, True, b"\1"),
+        record(ISOLINUX, SECTOR, True, b"ISOLINUX", su(nm(b"isolinux"))),
+        record(README, len(TEXT), False, b"README.TXT;1", su(nm(b"README.txt"))),
+    ])
+    isolinux = directory([
+        record(ISOLINUX, SECTOR, True, b"\0"),
+        record(ROOT, SECTOR, True, b"\1"),
+        record(VMLINUZ, len(KERNEL), False, b"VMLINUZ.;1", su(nm(b"vmlinuz"))),
+    ])
+    jroot = directory([
+        record(JROOT, SECTOR, True, b"\0"),
+        record(JROOT, SECTOR, True, b"\1"),
+        record(JISOLINUX, SECTOR, True, "isolinux".encode("utf-16-be")),
+        record(README, len(TEXT), False, "README.txt;1".encode("utf-16-be")),
+    ])
+    jisolinux = directory([
+        record(JISOLINUX, SECTOR, True, b"\0"),
+        record(JROOT, SECTOR, True, b"\1"),
+        record(VMLINUZ, len(KERNEL), False, "vmlinuz;1".encode("utf-16-be")),
+    ])
+    terminator = bytes([255]) + b"CD001\x01" + b"\0" * (SECTOR - 7)
+    sectors = [b"\0" * SECTOR] * 16 + [
+        descriptor(1, record(ROOT, SECTOR, True, b"\0")),
+        descriptor(2, record(JROOT, SECTOR, True, b"\0"), b"%/E"),
+        terminator,
+        root, isolinux, jroot, jisolinux,
+        KERNEL + b"\0" * (SECTOR - len(KERNEL)),
+        TEXT + b"\0" * (SECTOR - len(TEXT)),
+    ]
+    assert len(sectors) == TOTAL
+    return b"".join(sectors)
+
+
+for name, rock_ridge in (("rockridge.iso", True), ("joliet.iso", False)):
+    with open(name, "wb") as f:
+        f.write(image(rock_ridge))
@@ -1,7 +1,10 @@
 package core
 
 import (
+	"bytes"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
@@ -12,31 +15,130 @@ import (
 
 // readHandler is called when client starts file download from server
 func (s *Service) tftpReadHandler(filename string, rf io.ReaderFrom) error {
+	ot := rf.(tftp.OutgoingTransfer)
+	remoteAddr := ot.RemoteAddr()
+	transfer := s.tftpTransfers.begin(remoteAddr.String(), filename)
+	n, err := s.sendTFTPFile(filename, ot, rf, transfer)
+	t := s.tftpTransfers.finish(transfer, err)
+	s.metrics.observeTFTP(t, err)
+	s.publishTFTPTransfer(t, err)
+	fields := Fields{
+		"transfer":    t.ID,
+		"client":      t.Client,
+		"file":        t.File,
+		"bytes":       t.Bytes,
+		"size":        t.Size,
+		"duration":    t.Duration().Round(time.Millisecond).String(),
+		"blksize":     t.blockSize(),
+		"retransmits": t.Retransmits,
+		"outcome":     t.Outcome,
+	}
+	if err != nil {
+		s.Logger.Warning(withFields(fields, "[TFTP] transfer #%d of %s to %s %s after %d/%d bytes in %s (blksize %s, %d retransmits): %v",
+			t.ID, t.File, t.Client, t.Outcome, t.Bytes, t.Size, t.Duration().Round(time.Millisecond),
+			t.blockSize(), t.Retransmits, err))
+		return err
+	}
+	s.Logger.Info(withFields(fields, "[TFTP] tftp_files %s(%d) bytes sent to %s in %s (blksize %s, %d retransmits)",
+		filename, n, t.Client, t.Duration().Round(time.Millisecond), t.blockSize(), t.Retransmits))
+	return nil
+}
+
+// publishTFTPTransfer publishes a finished transfer on the event bus.
+func (s *Service) publishTFTPTransfer(t TFTPTransfer, err error) {
+	client, _, _ := net.SplitHostPort(t.Client)
+	e := BusEvent{
+		Topic:   TopicTFTPDownload,
+		MAC:     s.clientMAC(t.Client),
+		IP:      client,
+		Message: fmt.Sprintf("%s downloaded %s over TFTP", client, t.File),
+		Data: map[string]interface{}{
+			"transfer":    t.ID,
+			"file":        t.File,
+			"bytes":       t.Bytes,
+			"size":        t.Size,
+			"duration":    t.Duration().Round(time.Millisecond).String(),
+			"retransmits": t.Retransmits,
+			"outcome":     t.Outcome,
+		},
+	}
+	if err != nil {
+		e.Topic = TopicTFTPFailed
+		e.Message = fmt.Sprintf("TFTP transfer of %s to %s %s: %s", t.File, client, t.Outcome, err)
+		e.Data["error"] = err.Error()
+	}
+	s.bus.Publish(e)
+}
+
+// sendTFTPFile opens filename and sends it, tracking progress on transfer.
+func (s *Service) sendTFTPFile(filename string, ot tftp.OutgoingTransfer, rf io.ReaderFrom, transfer *TFTPTransfer) (int64, error) {
 	rootPath := filepath.Join(s.DocRoot, s.TFTPRoot, filename)
+	var file io.ReadCloser
+	var fileSize int64
+	var err error
+	if data, ok, renderErr := s.renderRequest(filename, transfer.Client, nil); ok {
+		if renderErr != nil {
+			return 0, renderErr
+		}
+		file, fileSize = ioutil.NopCloser(bytes.NewReader(data)), int64(len(data))
+	} else if img, inner, ok := findISOMount(s.isoMounts, filename); ok {
+		file, fileSize, err = openISOBootFile(img, inner)
+		if err != nil {
+			s.Logger.Errorf("[TFTP] tftp open err: %v", err)
+			return 0, err
+		}
+	} else if _, statErr := os.Stat(rootPath); os.IsNotExist(statErr) {
+		// Per-host pxelinux and GRUB configs are generated from the inventory.
+		data, ok := s.renderHostBootConfig(filename, transfer.Client)
+		if !ok {
+			s.Logger.Errorf("[TFTP] tftp open err: %v", statErr)
+			return 0, statErr
+		}
+		file, fileSize = ioutil.NopCloser(bytes.NewReader(data)), int64(len(data))
+	} else {
+		file, fileSize, err = s.openBootFile(rootPath)
+		if err != nil {
+			return 0, err
+		}
+	}
+	defer file.Close()
+	// Set transfer size before calling ReadFrom.
+	ot.SetSize(fileSize)
+	s.tftpTransfers.update(transfer, func(t *TFTPTransfer) {
+		t.Size = fileSize
+	})
+
+	return rf.ReadFrom(&progressReader{r: file, log: s.tftpTransfers, transfer: transfer})
+}
+
+// openBootFile opens a file for a TFTP transfer, going through the boot
+// file cache when it is enabled.
+func (s *Service) openBootFile(rootPath string) (io.ReadCloser, int64, error) {
+	if s.cache != nil {
+		data, fi, err := s.cache.Get(rootPath)
+		if err != nil {
+			s.Logger.Errorf("[TFTP] tftp open err: %v", err)
+			return nil, 0, err
+		}
+		if data != nil {
+			return ioutil.NopCloser(bytes.NewReader(data)), fi.Size(), nil
+		}
+	}
 	// open the file
 	file, err := os.Open(rootPath)
 	if err != nil {
 		s.Logger.Errorf("[TFTP] tftp open err: %v", err)
-		return err
+		return nil, 0, err
 	}
 	// Find the size of the file
 	fi, err := file.Stat()
 	if err != nil {
 		// Could not obtain stat, handle error
 		s.Logger.Errorf("[TFTP] file stat err: %v", err)
-		return err
+		file.Close()
+		return nil, 0, err
 	}
-	fileSize := fi.Size()
-	// Set transfer size before calling ReadFrom.
-	rf.(tftp.OutgoingTransfer).SetSize(fileSize)
-
-	n, err := rf.ReadFrom(file)
-	if err != nil {
-		//log.Errorf("[TFTP] tftp read err: %v", err)
-		return err
-	}
-	s.Logger.Infof("[TFTP] tftp_files %s(%d) bytes sent", filename, n)
-	return nil
+	return file, fi.Size(), nil
 }
 
 // writeHandler is called when client starts file upload to server
@@ -57,11 +159,33 @@ func (s *Service) tftWriteHandler(filename string, wt io.WriterTo) error {
 	return nil
 }
 
+// openISOBootFile opens a regular file inside an ISO image for a TFTP transfer.
+func openISOBootFile(img *isoImage, name string) (io.ReadCloser, int64, error) {
+	file, err := img.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, _ := file.Stat()
+	if fi.IsDir() {
+		return nil, 0, fmt.Errorf("%s is a directory", name)
+	}
+	return file, fi.Size(), nil
+}
+
+// newTFTPServer creates the TFTP server serving the boot files.
+func (s *Service) newTFTPServer() *tftp.Server {
+	tftpServer := tftp.NewServer(s.tftpReadHandler, s.tftWriteHandler)
+	tftpServer.SetTimeout(s.tftpTransfers.timeout)
+	tftpServer.SetBackoff(s.tftpTransfers.backoff)
+	return tftpServer
+}
+
 func (s *Service) serveTFTP(l *net.UDPConn) error {
 	rootPath := filepath.Join(s.DocRoot, s.TFTPRoot)
-	tftpServer := tftp.NewServer(s.tftpReadHandler, s.tftWriteHandler)
-	tftpServer.SetTimeout(5 * time.Second) // optional
 	s.Logger.Infof("[TFTP] starting tftp server on port %s(UDP) and handle on path: %s", s.TFTPPort, rootPath)
-	tftpServer.Serve(l) // blocks until s.Shutdown() is called
+	stop := make(chan struct{})
+	go s.watchTFTPTransfers(stop)
+	s.tftpServer.Serve(l) // blocks until s.Shutdown() is called
+	close(stop)
 	return nil
 }
@@ -0,0 +1,268 @@
+package core
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TFTP transfer outcomes.
+const (
+	TransferInProgress = "in-progress"
+	TransferComplete   = "complete"
+	TransferAborted    = "aborted" // failed after part of the file was sent
+	TransferFailed     = "failed"  // failed before any data was sent
+)
+
+// TFTPTransfer records the statistics of a single TFTP read transfer.
+type TFTPTransfer struct {
+	ID           uint64            `json:"id"`
+	Client       string            `json:"client"`
+	File         string            `json:"file"`
+	Size         int64             `json:"size"`
+	Bytes        int64             `json:"bytes"`
+	Options      map[string]string `json:"options"` // options the client negotiated, as far as they show: blksize
+	Start        time.Time         `json:"start"`
+	End          time.Time         `json:"end"`
+	LastProgress time.Time         `json:"last_progress"`
+	Outcome      string            `json:"outcome"`
+	Stalled      bool              `json:"stalled"`
+	Retransmits  int64             `json:"retransmits"` // packets sent again after a timeout
+	Error        string            `json:"error,omitempty"`
+}
+
+// Duration returns how long the transfer ran, or has been running.
+func (t TFTPTransfer) Duration() time.Duration {
+	if t.End.IsZero() {
+		return time.Since(t.Start)
+	}
+	return t.End.Sub(t.Start)
+}
+
+// snapshot copies a transfer that may still be updated by its sender.
+func (t *TFTPTransfer) snapshot() TFTPTransfer {
+	c := *t
+	c.Options = make(map[string]string, len(t.Options))
+	for k, v := range t.Options {
+		c.Options[k] = v
+	}
+	return c
+}
+
+// tftpTransferLog keeps the active transfers and a ring of recent ones.
+type tftpTransferLog struct {
+	lock        sync.Mutex
+	active      map[uint64]*TFTPTransfer
+	recent      []TFTPTransfer
+	next        int
+	full        bool
+	nextID      uint64
+	timeout     time.Duration            // server round-trip timeout
+	stallAfter  time.Duration            // no progress for this long flags a stall
+	retransmits uint64                   // server wide, counted by the backoff handler
+	senders     map[uint64]*TFTPTransfer // active transfers by the goroutine sending them
+}
+
+func newTFTPTransferLog(size int, timeout, stallAfter time.Duration) *tftpTransferLog {
+	if size <= 0 {
+		size = 256
+	}
+	return &tftpTransferLog{
+		active:     make(map[uint64]*TFTPTransfer),
+		senders:    make(map[uint64]*TFTPTransfer),
+		recent:     make([]TFTPTransfer, size),
+		timeout:    timeout,
+		stallAfter: stallAfter,
+	}
+}
+
+// begin registers a new transfer, sent by the calling goroutine.
+func (l *tftpTransferLog) begin(client, file string) *TFTPTransfer {
+	now := time.Now()
+	sender := goroutineID()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.nextID++
+	t := &TFTPTransfer{
+		ID:           l.nextID,
+		Client:       client,
+		File:         file,
+		Options:      make(map[string]string),
+		Start:        now,
+		LastProgress: now,
+		Outcome:      TransferInProgress,
+	}
+	l.active[t.ID] = t
+	l.senders[sender] = t
+	return t
+}
+
+// finish completes a transfer and moves it into the recent ring.
+func (l *tftpTransferLog) finish(t *TFTPTransfer, err error) TFTPTransfer {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	t.End = time.Now()
+	switch {
+	case err == nil:
+		t.Outcome = TransferComplete
+	case t.Bytes > 0:
+		t.Outcome = TransferAborted
+	default:
+		t.Outcome = TransferFailed
+	}
+	if err != nil {
+		t.Error = err.Error()
+	}
+	delete(l.active, t.ID)
+	for sender, active := range l.senders {
+		if active == t {
+			delete(l.senders, sender)
+		}
+	}
+	l.recent[l.next] = *t
+	l.next = (l.next + 1) % len(l.recent)
+	if l.next == 0 {
+		l.full = true
+	}
+	return *t
+}
+
+// update applies fn to a transfer while holding the log lock.
+func (l *tftpTransferLog) update(t *TFTPTransfer, fn func(t *TFTPTransfer)) {
+	l.lock.Lock()
+	fn(t)
+	l.lock.Unlock()
+}
+
+// Recent returns the finished transfers, newest first.
+func (l *tftpTransferLog) Recent() []TFTPTransfer {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	count := l.next
+	if l.full {
+		count = len(l.recent)
+	}
+	transfers := make([]TFTPTransfer, 0, count)
+	for i := 1; i <= count; i++ {
+		transfers = append(transfers, l.recent[(l.next-i+len(l.recent))%len(l.recent)])
+	}
+	return transfers
+}
+
+// Active returns the transfers in progress.
+func (l *tftpTransferLog) Active() []TFTPTransfer {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	transfers := make([]TFTPTransfer, 0, len(l.active))
+	for _, t := range l.active {
+		transfers = append(transfers, t.snapshot())
+	}
+	return transfers
+}
+
+// checkStalls flags active transfers without progress for stallAfter and
+// returns the ones that stalled since the last check.
+func (l *tftpTransferLog) checkStalls() []TFTPTransfer {
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var stalled []TFTPTransfer
+	for _, t := range l.active {
+		if !t.Stalled && now.Sub(t.LastProgress) > l.stallAfter {
+			t.Stalled = true
+			stalled = append(stalled, t.snapshot())
+		}
+	}
+	return stalled
+}
+
+// backoff is installed as the TFTP server backoff handler so retransmits
+// are counted, server wide and per transfer. The TFTP library calls it on
+// the goroutine sending the transfer, without saying which transfer it
+// is, so the transfer is found by the goroutine.
+func (l *tftpTransferLog) backoff(attempt int) time.Duration {
+	atomic.AddUint64(&l.retransmits, 1)
+	sender := goroutineID()
+	l.lock.Lock()
+	if t, ok := l.senders[sender]; ok {
+		t.Retransmits++
+	}
+	l.lock.Unlock()
+	return time.Duration(attempt+1) * 100 * time.Millisecond
+}
+
+// goroutineID returns the ID of the calling goroutine, from the first line
+// of its stack trace: "goroutine 42 [running]:".
+func goroutineID() uint64 {
+	var buf [64]byte
+	fields := bytes.Fields(buf[:runtime.Stack(buf[:], false)])
+	if len(fields) < 2 {
+		return 0
+	}
+	id, _ := strconv.ParseUint(string(fields[1]), 10, 64)
+	return id
+}
+
+// Retransmits returns the number of retransmitted packets on the server.
+func (l *tftpTransferLog) Retransmits() uint64 {
+	return atomic.LoadUint64(&l.retransmits)
+}
+
+// tftpDefaultBlockSize is the block size of transfers that did not
+// negotiate the blksize option (RFC 1350).
+const tftpDefaultBlockSize = 512
+
+// blockSize returns the block size of the transfer.
+func (t TFTPTransfer) blockSize() string {
+	if blksize, ok := t.Options["blksize"]; ok {
+		return blksize
+	}
+	return strconv.Itoa(tftpDefaultBlockSize)
+}
+
+// progressReader tracks the progress of a transfer. The TFTP sender reads
+// one block at a time into a buffer of the block size in effect, so a
+// first read of another size than the default shows that the client
+// negotiated blksize. The other options of the request are not visible.
+type progressReader struct {
+	r        io.Reader
+	log      *tftpTransferLog
+	transfer *TFTPTransfer
+	started  bool
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	first := !p.started
+	p.started = true
+	p.log.update(p.transfer, func(t *TFTPTransfer) {
+		if first && len(b) != tftpDefaultBlockSize {
+			t.Options["blksize"] = strconv.Itoa(len(b))
+		}
+		t.Bytes += int64(n)
+		t.LastProgress = time.Now()
+		t.Stalled = false
+	})
+	return n, err
+}
+
+// watchTFTPTransfers logs stalled transfers until stop is closed.
+func (s *Service) watchTFTPTransfers(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, t := range s.tftpTransfers.checkStalls() {
+				s.Logger.Warningf("[TFTP] transfer #%d of %s to %s stalled at %d/%d bytes (no progress for %s, %d retransmits)",
+					t.ID, t.File, t.Client, t.Bytes, t.Size, time.Since(t.LastProgress).Round(time.Second), t.Retransmits)
+			}
+		}
+	}
+}
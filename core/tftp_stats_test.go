@@ -0,0 +1,114 @@
+package core
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTFTPTransferLogKeepsTheNewestTransfers(t *testing.T) {
+	log := newTFTPTransferLog(3, time.Second, time.Minute)
+	if recent := log.Recent(); len(recent) != 0 {
+		t.Fatalf("Recent of an empty log = %v", recent)
+	}
+	for i := 0; i < 5; i++ {
+		log.finish(log.begin("10.0.0.1:1000", "undionly.kpxe"), nil)
+	}
+	recent := log.Recent()
+	var ids []uint64
+	for _, transfer := range recent {
+		ids = append(ids, transfer.ID)
+	}
+	if len(ids) != 3 || ids[0] != 5 || ids[1] != 4 || ids[2] != 3 {
+		t.Errorf("Recent IDs = %v, want [5 4 3]", ids)
+	}
+	if active := log.Active(); len(active) != 0 {
+		t.Errorf("%d transfers still active", len(active))
+	}
+}
+
+func TestTFTPTransferLogOutcomes(t *testing.T) {
+	log := newTFTPTransferLog(10, time.Second, time.Minute)
+	complete := log.begin("10.0.0.1:1000", "pxelinux.0")
+	complete.Bytes = 100
+	aborted := log.begin("10.0.0.2:1000", "initrd.img")
+	aborted.Bytes = 50
+	failed := log.begin("10.0.0.3:1000", "vmlinuz")
+	for _, test := range []struct {
+		transfer *TFTPTransfer
+		err      error
+		want     string
+	}{
+		{complete, nil, TransferComplete},
+		{aborted, errors.New("timeout"), TransferAborted},
+		{failed, errors.New("file not found"), TransferFailed},
+	} {
+		got := log.finish(test.transfer, test.err)
+		if got.Outcome != test.want {
+			t.Errorf("%s: outcome %s, want %s", got.File, got.Outcome, test.want)
+		}
+		if test.err != nil && got.Error != test.err.Error() {
+			t.Errorf("%s: error %q, want %q", got.File, got.Error, test.err)
+		}
+		if got.End.IsZero() {
+			t.Errorf("%s: no end time", got.File)
+		}
+	}
+}
+
+func TestTFTPTransferLogFlagsStalls(t *testing.T) {
+	log := newTFTPTransferLog(10, time.Second, time.Minute)
+	transfer := log.begin("10.0.0.1:1000", "initrd.img")
+	if stalled := log.checkStalls(); len(stalled) != 0 {
+		t.Fatalf("a new transfer is stalled: %v", stalled)
+	}
+
+	log.update(transfer, func(t *TFTPTransfer) { t.LastProgress = time.Now().Add(-2 * time.Minute) })
+	if stalled := log.checkStalls(); len(stalled) != 1 || !stalled[0].Stalled {
+		t.Fatalf("checkStalls = %v, want the transfer", stalled)
+	}
+	if stalled := log.checkStalls(); len(stalled) != 0 {
+		t.Errorf("a stall is reported again: %v", stalled)
+	}
+
+	r := &progressReader{r: strings.NewReader("initrd"), log: log, transfer: transfer}
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	active := log.Active()
+	if len(active) != 1 || active[0].Stalled || active[0].Bytes != 6 {
+		t.Errorf("after progress: %+v, want 6 bytes and no stall", active)
+	}
+}
+
+func TestTFTPTransferLogCountsRetransmitsPerTransfer(t *testing.T) {
+	log := newTFTPTransferLog(10, time.Second, time.Minute)
+	transfer := log.begin("10.0.0.1:1000", "initrd.img")
+	log.backoff(0)
+	log.backoff(1)
+	done := make(chan struct{})
+	go func() {
+		// Another transfer's sender, which the transfer must not count.
+		other := log.begin("10.0.0.2:1000", "vmlinuz")
+		log.backoff(0)
+		log.finish(other, nil)
+		close(done)
+	}()
+	<-done
+	got := log.finish(transfer, nil)
+	if got.Retransmits != 2 {
+		t.Errorf("transfer has %d retransmits, want 2", got.Retransmits)
+	}
+	if other := log.Recent()[1]; other.Retransmits != 1 {
+		t.Errorf("other transfer has %d retransmits, want 1", other.Retransmits)
+	}
+	if n := log.Retransmits(); n != 3 {
+		t.Errorf("server has %d retransmits, want 3", n)
+	}
+	log.backoff(0) // after the transfer finished
+	if n := log.Retransmits(); n != 4 {
+		t.Errorf("server has %d retransmits, want 4", n)
+	}
+}
@@ -0,0 +1,72 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Validate checks the loaded configuration and inventory and parses every
+// template; in static mode the templates are also rendered, in memory. It
+// writes no files and opens no sockets, so it can run in CI. It returns
+// the number of templates.
+func (s *Service) Validate() (int, error) {
+	if err := s.validateConfig(); err != nil {
+		return 0, err
+	}
+	s.inventory.load(s.Profiles, s.Hosts)
+	parsed, err := parseTemplates(filepath.Join(s.DocRoot, templatePath), s.SecretsEnvPrefix)
+	if err != nil {
+		return 0, err
+	}
+	if s.TemplateMode == TemplateModeStatic {
+		if _, _, err := s.renderTemplates(parsed); err != nil {
+			return 0, err
+		}
+	}
+	return len(parsed), nil
+}
+
+// RenderTemplate renders the template of the file name, a path below the
+// HTTP root such as linux/ks/centos7.ks, as request mode would for the
+// host with the MAC address, and writes it to w. An empty mac renders for
+// an unknown client. Like Validate, it has no side effects.
+func (s *Service) RenderTemplate(mac, name string, w io.Writer) error {
+	if err := s.validateConfig(); err != nil {
+		return err
+	}
+	s.inventory.load(s.Profiles, s.Hosts)
+	query := url.Values{}
+	clientIP := ""
+	if mac != "" {
+		host, _, ok := s.inventory.lookup(mac)
+		if !ok {
+			return fmt.Errorf("unknown host %s", mac)
+		}
+		query.Set("mac", host.MAC)
+		clientIP = host.IP
+	}
+	file := strings.TrimPrefix(path.Clean("/"+strings.TrimSuffix(filepath.ToSlash(name), ".tmpl")), "/") + ".tmpl"
+	if isSharedTemplate(file) {
+		return fmt.Errorf("%s/%s is a layout or partial, it is not rendered by itself", templatePath, file)
+	}
+	root := filepath.Join(s.DocRoot, templatePath)
+	shared, err := parseSharedTemplates(root, s.SecretsEnvPrefix)
+	if err != nil {
+		return err
+	}
+	tmpl, err := parseTemplateFile(shared, root, file)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, s.newRequestTemplateData(clientIP, query)); err != nil {
+		return newTemplateError(file, err)
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,72 @@
+package core
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// unattendPath is the HTTP path of the files wimboot injects into Windows
+// PE for a host: <NextServer>/unattend/<mac>/[<token>/]<file>. Without a
+// MAC address the client is found by its lease or reservation.
+const unattendPath = "/unattend/"
+
+// windowsTemplateDir holds the templates of the injected files, below the
+// templates directory; windows/<profile>/<file>.tmpl overrides
+// windows/<file>.tmpl for the hosts of a profile.
+const windowsTemplateDir = "windows"
+
+// unattendFiles are the files injected into Windows PE. wimboot puts them
+// in X:\Windows\System32, where winpeshl.ini replaces the setup that
+// Windows PE starts by install.bat, which runs setup with autounattend.xml.
+var unattendFiles = []string{"autounattend.xml", "winpeshl.ini", "install.bat"}
+
+// windowsMediaFiles are the files wimboot boots from an extracted Windows
+// media tree, by their path below it and the name wimboot expects.
+var windowsMediaFiles = []struct{ name, path string }{
+	{"BCD", "boot/bcd"},
+	{"boot.sdi", "boot/boot.sdi"},
+	{"boot.wim", "sources/boot.wim"},
+}
+
+// bootFile is a file iPXE downloads under another name, for wimboot.
+type bootFile struct {
+	Name string
+	URL  string
+}
+
+// windowsBootFiles returns the files wimboot is given for a Windows
+// profile: the injected files of the host, below unattend, and the boot
+// files of the profile's media.
+func windowsBootFiles(nextServer, unattend string, profile Profile) []bootFile {
+	var files []bootFile
+	for _, name := range unattendFiles {
+		files = append(files, bootFile{Name: name, URL: unattend + name})
+	}
+	for _, f := range windowsMediaFiles {
+		files = append(files, bootFile{Name: f.name, URL: bootFileURL(nextServer, strings.TrimSuffix(profile.Windows, "/")+"/"+f.path)})
+	}
+	return files
+}
+
+// windowsPassword encodes a password for an unattend file with
+// <PlainText>false</PlainText>: base64 of the UTF-16LE password followed
+// by the element name, {{.Secret "admin_password" | windowsPassword "AdministratorPassword"}}.
+func windowsPassword(element, password string) string {
+	units := utf16.Encode([]rune(password + element))
+	b := make([]byte, 0, 2*len(units))
+	for _, u := range units {
+		b = append(b, byte(u), byte(u>>8))
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// xmlEscape escapes a value for the text or an attribute of an XML file,
+// such as an unattend file: {{.Host.Hostname | xml}}.
+func xmlEscape(v interface{}) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(fmt.Sprint(v)))
+	return b.String()
+}
@@ -3,6 +3,7 @@ module github.com/DongJeremy/pxesrv
 go 1.14
 
 require (
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/krolaw/dhcp4 v0.0.0-20190909130307-a50d88189771
 	github.com/mash/go-accesslog v1.1.0
 	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
@@ -10,4 +11,5 @@ require (
 	github.com/spf13/viper v1.6.2
 	golang.org/x/net v0.0.0-20200320220750-118fecf932d8 // indirect
 	golang.org/x/sys v0.0.0-20200321134203-328b4cd54aae // indirect
+	gopkg.in/yaml.v2 v2.2.4
 )
@@ -2,17 +2,152 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/DongJeremy/pxesrv/core"
 )
 
+// Exit codes reported to the service manager.
+const (
+	exitOK              = 0
+	exitFailure         = 1
+	exitShutdownTimeout = 2
+)
+
 func main() {
 	var configFileName = flag.String("c", "pxe.yml", "config file path (default config.ini)")
+	flag.Usage = usage
 	flag.Parse()
 	service := core.NewService()
+
+	switch flag.Arg(0) {
+	case "":
+	case "rearm":
+		os.Exit(rearm(service, *configFileName, flag.Args()[1:]))
+	case "validate":
+		os.Exit(validate(service, *configFileName, flag.Args()[1:]))
+	case "render":
+		os.Exit(render(service, *configFileName, flag.Args()[1:]))
+	default:
+		usage()
+		os.Exit(exitFailure)
+	}
+
 	err := service.Initialize(*configFileName)
 	if err != nil {
-		service.Logger.Panic(err)
+		fmt.Fprintf(os.Stderr, "pxesrv: %s\n", err)
+		os.Exit(exitFailure)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		service.Logger.Infof("[PXES] received signal %s", sig)
+		service.Shutdown()
+	}()
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			service.Reload()
+		}
+	}()
+
+	switch err := service.Start(); err {
+	case nil:
+		os.Exit(exitOK)
+	case core.ErrShutdownTimeout:
+		os.Exit(exitShutdownTimeout)
+	default:
+		os.Exit(exitFailure)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [-c pxe.yml] [command]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Without a command the pxesrv daemon is started.\n\nCommands:\n")
+	fmt.Fprintf(os.Stderr, "  rearm <mac>...  reinstall hosts on their next PXE boot\n")
+	fmt.Fprintf(os.Stderr, "  validate        check the config and templates without starting servers\n")
+	fmt.Fprintf(os.Stderr, "  render [--host <mac>] --template <file>\n")
+	fmt.Fprintf(os.Stderr, "                  print a template rendered for a host, e.g. linux/ks/centos7.ks\n\nOptions:\n")
+	flag.PrintDefaults()
+}
+
+// rearm asks the running daemon to reinstall the given hosts.
+func rearm(service *core.Service, configFileName string, macs []string) int {
+	if len(macs) == 0 {
+		usage()
+		return exitFailure
+	}
+	if err := service.LoadConfig(configFileName); err != nil {
+		fmt.Fprintf(os.Stderr, "pxesrv: %s\n", err)
+		return exitFailure
+	}
+	code := exitOK
+	for _, mac := range macs {
+		status, err := service.RemoteRearm(mac)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "pxesrv: rearm %s: %s\n", mac, err)
+			code = exitFailure
+			continue
+		}
+		fmt.Printf("%s %s\n", status.MAC, status.State)
+	}
+	return code
+}
+
+// validate checks the config and every template, for CI.
+func validate(service *core.Service, configFileName string, args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", configFileName, "config file path")
+	flags.Parse(args)
+	if err := service.LoadConfig(configFileName); err != nil {
+		fmt.Fprintf(os.Stderr, "pxesrv: %s\n", err)
+		return exitFailure
+	}
+	count, err := service.Validate()
+	if err != nil {
+		printError(err)
+		return exitFailure
+	}
+	fmt.Printf("%s: configuration and %d templates are valid\n", configFileName, count)
+	return exitOK
+}
+
+// render prints a template rendered for a host.
+func render(service *core.Service, configFileName string, args []string) int {
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", configFileName, "config file path")
+	host := flags.String("host", "", "MAC address of the host to render for")
+	name := flags.String("template", "", "rendered file below the HTTP root, e.g. linux/ks/centos7.ks")
+	flags.Parse(args)
+	if *name == "" {
+		usage()
+		return exitFailure
+	}
+	if err := service.LoadConfig(configFileName); err != nil {
+		fmt.Fprintf(os.Stderr, "pxesrv: %s\n", err)
+		return exitFailure
+	}
+	if err := service.RenderTemplate(*host, *name, os.Stdout); err != nil {
+		printError(err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// printError prints an error, with one line per template error.
+func printError(err error) {
+	if errs, ok := err.(core.TemplateErrors); ok {
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "pxesrv: %s\n", e)
+		}
+		return
 	}
-	service.Start()
+	fmt.Fprintf(os.Stderr, "pxesrv: %s\n", err)
 }